@@ -0,0 +1,176 @@
+package example
+
+import (
+	"bucketdb/db"
+	"bucketdb/tests"
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Same fields as Tx but without generated methods, encoded by reflection.
+type plainTx Tx
+
+func testTx() Tx {
+	return Tx{
+		Type:   2,
+		Nonce:  444,
+		Gas:    21000,
+		To:     &common.Address{1, 2, 3},
+		From:   common.Address{4, 5, 6},
+		Hash:   common.Hash{7, 8, 9},
+		Value:  big.NewInt(333444),
+		V:      big.NewInt(1),
+		Data:   []byte{1, 2, 3},
+		Memo:   "transfer",
+		Failed: true,
+		Fee:    0.25,
+		Index:  -5,
+		Delta:  -300,
+		Ids:    []int32{1, 2, 3},
+		Logs:   []Log{{Address: common.Address{1}, Topics: []common.Hash{{2}, {3}}}},
+		Labels: map[string]string{"a": "b", "c": "d"},
+	}
+}
+
+func TestGeneratedEncode(t *testing.T) {
+	tx := testTx()
+
+	raw, err := db.Encode(plainTx(tx))
+	tests.Assert(t, nil, err)
+
+	generated, err := tx.Encode()
+	tests.Assert(t, nil, err)
+	tests.Assert(t, true, bytes.Equal(raw.Bytes(), generated))
+
+	// Zero values too.
+	raw, _ = db.Encode(plainTx{})
+	generated, _ = (&Tx{}).Encode()
+	tests.Assert(t, true, bytes.Equal(raw.Bytes(), generated))
+
+	// Empty slices are written like nil ones.
+	raw, _ = db.Encode(plainTx{Data: []byte{}})
+	generated, _ = (&Tx{Data: []byte{}}).Encode()
+	tests.Assert(t, true, bytes.Equal(raw.Bytes(), generated))
+
+	// Values written in KeepEmpty mode are decoded as empty.
+	raw, _ = db.KeepEmpty.Encode(plainTx{Data: []byte{}})
+
+	decoded := Tx{}
+	tests.Assert(t, nil, decoded.Decode(raw.Bytes()))
+	tests.AssertEqual(t, []byte{}, decoded.Data)
+}
+
+func TestGeneratedDecode(t *testing.T) {
+	tx := testTx()
+	raw, _ := db.Encode(plainTx(tx))
+
+	decoded := Tx{}
+	err := decoded.Decode(raw.Bytes())
+	tests.Assert(t, nil, err)
+
+	// Nil pointers are decoded as zero values.
+	tx.R, tx.S = new(big.Int), new(big.Int)
+	tests.AssertEqual(t, tx, decoded)
+}
+
+// Generated types are encoded by db.Encode with their methods, layout
+// stays the same as before methods were generated.
+func TestGeneratedBitbox(t *testing.T) {
+	tx := testTx()
+
+	raw, _ := db.Encode(plainTx(tx))
+	generated, err := db.Encode(tx)
+	tests.Assert(t, nil, err)
+	tests.Assert(t, true, bytes.Equal(raw.Bytes(), generated.Bytes()))
+
+	decoded := Tx{}
+	tests.Assert(t, nil, db.Decode(raw, &decoded))
+	tests.AssertEqual(t, tx.Hash, decoded.Hash)
+	tests.AssertEqual(t, tx.Logs, decoded.Logs)
+
+	// Other modes don't use generated methods.
+	raw, _ = db.Varint.Encode(plainTx(tx))
+	generated, _ = db.Varint.Encode(tx)
+	tests.Assert(t, true, bytes.Equal(raw.Bytes(), generated.Bytes()))
+
+	decoded = Tx{}
+	tests.Assert(t, nil, db.Varint.Decode(raw, &decoded))
+	tests.AssertEqual(t, tx.Memo, decoded.Memo)
+}
+
+func TestGeneratedDecodeErrors(t *testing.T) {
+	tx := testTx()
+	raw, _ := tx.Encode()
+
+	err := (&Tx{}).Decode(raw[:5])
+
+	var derr *db.DecodeError
+	tests.Assert(t, true, errors.As(err, &derr))
+	tests.Assert(t, "example.Tx.Nonce", derr.Path)
+}
+
+type plainReceipt Receipt
+
+func TestGeneratedTags(t *testing.T) {
+	for _, r := range []Receipt{
+		{Status: 1, TxHash: common.Hash{1}, Bloom: make([]byte, 8), Cache: []byte{1}, GasUsed: 21000},
+		{To: &common.Address{2}, Bloom: make([]byte, 8)},
+	} {
+		raw, err := db.Encode(plainReceipt(r))
+		tests.Assert(t, nil, err)
+
+		generated, err := r.Encode()
+		tests.Assert(t, nil, err)
+		tests.Assert(t, true, bytes.Equal(raw.Bytes(), generated))
+
+		decoded := Receipt{}
+		err = decoded.Decode(raw.Bytes())
+		tests.Assert(t, nil, err)
+
+		r.Cache = nil
+		tests.AssertEqual(t, r, decoded)
+	}
+}
+
+func BenchmarkGeneratedEncode(b *testing.B) {
+	tx := testTx()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		tx.Encode()
+	}
+}
+
+func BenchmarkReflectEncode(b *testing.B) {
+	tx := plainTx(testTx())
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		db.Encode(tx)
+	}
+}
+
+func BenchmarkGeneratedDecode(b *testing.B) {
+	tx := testTx()
+	raw, _ := tx.Encode()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		tx := Tx{}
+		tx.Decode(raw)
+	}
+}
+
+func BenchmarkReflectDecode(b *testing.B) {
+	raw, _ := db.Encode(plainTx(testTx()))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		tx := plainTx{}
+		db.Decode(bytes.NewBuffer(raw.Bytes()), &tx)
+	}
+}
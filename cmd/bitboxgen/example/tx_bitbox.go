@@ -0,0 +1,319 @@
+// Code generated by bitboxgen. DO NOT EDIT.
+
+package example
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+
+	"bucketdb/db"
+)
+
+// Encode Tx appending it to buf.
+func (t *Tx) EncodeTo(buf *bytes.Buffer) error {
+	buf.WriteByte(t.Type)
+
+	buf.Write(binary.BigEndian.AppendUint64(buf.AvailableBuffer(), t.Nonce))
+
+	if err := db.EncodeTo(buf, t.Gas); err != nil {
+		return err
+	}
+
+	if err := db.EncodeTo(buf, t.To); err != nil {
+		return err
+	}
+
+	buf.Write(t.From[:])
+
+	buf.Write(t.Hash[:])
+
+	{
+		var raw []byte
+		if t.Value != nil {
+			raw = t.Value.Bytes()
+		}
+		buf.Write(binary.BigEndian.AppendUint64(buf.AvailableBuffer(), uint64(len(raw))))
+		buf.Write(raw)
+	}
+
+	{
+		var raw []byte
+		if t.V != nil {
+			raw = t.V.Bytes()
+		}
+		buf.Write(binary.BigEndian.AppendUint64(buf.AvailableBuffer(), uint64(len(raw))))
+		buf.Write(raw)
+	}
+
+	{
+		var raw []byte
+		if t.R != nil {
+			raw = t.R.Bytes()
+		}
+		buf.Write(binary.BigEndian.AppendUint64(buf.AvailableBuffer(), uint64(len(raw))))
+		buf.Write(raw)
+	}
+
+	{
+		var raw []byte
+		if t.S != nil {
+			raw = t.S.Bytes()
+		}
+		buf.Write(binary.BigEndian.AppendUint64(buf.AvailableBuffer(), uint64(len(raw))))
+		buf.Write(raw)
+	}
+
+	buf.Write(binary.BigEndian.AppendUint64(buf.AvailableBuffer(), uint64(len(t.Data))))
+	buf.Write(t.Data)
+
+	buf.Write(binary.BigEndian.AppendUint64(buf.AvailableBuffer(), uint64(len(t.Memo))))
+	buf.WriteString(t.Memo)
+
+	if t.Failed {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+
+	buf.Write(binary.BigEndian.AppendUint64(buf.AvailableBuffer(), math.Float64bits(t.Fee)))
+
+	buf.Write(binary.BigEndian.AppendUint64(buf.AvailableBuffer(), uint64(t.Index)))
+
+	buf.Write(binary.BigEndian.AppendUint16(buf.AvailableBuffer(), uint16(t.Delta)))
+
+	if err := db.EncodeTo(buf, t.Ids); err != nil {
+		return err
+	}
+
+	if err := db.EncodeTo(buf, t.Logs); err != nil {
+		return err
+	}
+
+	if err := db.EncodeTo(buf, t.Labels); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Encode Tx into bitbox format.
+func (t *Tx) Encode() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, 180))
+
+	err := t.EncodeTo(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decode Tx from buf.
+func (t *Tx) DecodeFrom(buf *bytes.Buffer) error {
+	if buf.Len() < 1 {
+		return &db.DecodeError{Path: "example.Tx.Type", Err: db.ErrShortBuffer}
+	}
+	t.Type = buf.Next(1)[0]
+
+	if buf.Len() < 8 {
+		return &db.DecodeError{Path: "example.Tx.Nonce", Err: db.ErrShortBuffer}
+	}
+	t.Nonce = binary.BigEndian.Uint64(buf.Next(8))
+
+	if err := db.Decode(buf, &t.Gas); err != nil {
+		return err
+	}
+
+	if err := db.Decode(buf, &t.To); err != nil {
+		return err
+	}
+
+	if buf.Len() < len(t.From) {
+		return &db.DecodeError{Path: "example.Tx.From", Err: db.ErrShortBuffer}
+	}
+	copy(t.From[:], buf.Next(len(t.From)))
+
+	if buf.Len() < len(t.Hash) {
+		return &db.DecodeError{Path: "example.Tx.Hash", Err: db.ErrShortBuffer}
+	}
+	copy(t.Hash[:], buf.Next(len(t.Hash)))
+
+	if err := db.Decode(buf, &t.Value); err != nil {
+		return err
+	}
+
+	if err := db.Decode(buf, &t.V); err != nil {
+		return err
+	}
+
+	if err := db.Decode(buf, &t.R); err != nil {
+		return err
+	}
+
+	if err := db.Decode(buf, &t.S); err != nil {
+		return err
+	}
+
+	if err := db.Decode(buf, &t.Data); err != nil {
+		return err
+	}
+
+	if err := db.Decode(buf, &t.Memo); err != nil {
+		return err
+	}
+
+	if buf.Len() < 1 {
+		return &db.DecodeError{Path: "example.Tx.Failed", Err: db.ErrShortBuffer}
+	}
+	t.Failed = buf.Next(1)[0] != 0
+
+	if buf.Len() < 8 {
+		return &db.DecodeError{Path: "example.Tx.Fee", Err: db.ErrShortBuffer}
+	}
+	t.Fee = math.Float64frombits(binary.BigEndian.Uint64(buf.Next(8)))
+
+	if buf.Len() < 8 {
+		return &db.DecodeError{Path: "example.Tx.Index", Err: db.ErrShortBuffer}
+	}
+	t.Index = int(binary.BigEndian.Uint64(buf.Next(8)))
+
+	if buf.Len() < 2 {
+		return &db.DecodeError{Path: "example.Tx.Delta", Err: db.ErrShortBuffer}
+	}
+	t.Delta = int16(binary.BigEndian.Uint16(buf.Next(2)))
+
+	if err := db.Decode(buf, &t.Ids); err != nil {
+		return err
+	}
+
+	if err := db.Decode(buf, &t.Logs); err != nil {
+		return err
+	}
+
+	if err := db.Decode(buf, &t.Labels); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Decode Tx from bitbox format.
+func (t *Tx) Decode(raw []byte) error {
+	return t.DecodeFrom(bytes.NewBuffer(raw))
+}
+
+// Encode Log appending it to buf.
+func (l *Log) EncodeTo(buf *bytes.Buffer) error {
+	buf.Write(l.Address[:])
+
+	if err := db.EncodeTo(buf, l.Topics); err != nil {
+		return err
+	}
+
+	buf.Write(binary.BigEndian.AppendUint64(buf.AvailableBuffer(), uint64(len(l.Data))))
+	buf.Write(l.Data)
+
+	return nil
+}
+
+// Encode Log into bitbox format.
+func (l *Log) Encode() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, 48))
+
+	err := l.EncodeTo(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decode Log from buf.
+func (l *Log) DecodeFrom(buf *bytes.Buffer) error {
+	if buf.Len() < len(l.Address) {
+		return &db.DecodeError{Path: "example.Log.Address", Err: db.ErrShortBuffer}
+	}
+	copy(l.Address[:], buf.Next(len(l.Address)))
+
+	if err := db.Decode(buf, &l.Topics); err != nil {
+		return err
+	}
+
+	if err := db.Decode(buf, &l.Data); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Decode Log from bitbox format.
+func (l *Log) Decode(raw []byte) error {
+	return l.DecodeFrom(bytes.NewBuffer(raw))
+}
+
+// Encode Receipt appending it to buf.
+func (r *Receipt) EncodeTo(buf *bytes.Buffer) error {
+	if err := db.EncodeField(buf, r.Status, "varint"); err != nil {
+		return err
+	}
+
+	if err := db.EncodeField(buf, r.TxHash, "fixed=32"); err != nil {
+		return err
+	}
+
+	if err := db.EncodeField(buf, r.To, "optional"); err != nil {
+		return err
+	}
+
+	if err := db.EncodeField(buf, r.Bloom, "fixed=8"); err != nil {
+		return err
+	}
+
+	buf.Write(binary.BigEndian.AppendUint64(buf.AvailableBuffer(), r.GasUsed))
+
+	return nil
+}
+
+// Encode Receipt into bitbox format.
+func (r *Receipt) Encode() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, 64))
+
+	err := r.EncodeTo(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decode Receipt from buf.
+func (r *Receipt) DecodeFrom(buf *bytes.Buffer) error {
+	if err := db.DecodeField(buf, &r.Status, "varint"); err != nil {
+		return err
+	}
+
+	if err := db.DecodeField(buf, &r.TxHash, "fixed=32"); err != nil {
+		return err
+	}
+
+	if err := db.DecodeField(buf, &r.To, "optional"); err != nil {
+		return err
+	}
+
+	if err := db.DecodeField(buf, &r.Bloom, "fixed=8"); err != nil {
+		return err
+	}
+
+	if buf.Len() < 8 {
+		return &db.DecodeError{Path: "example.Receipt.GasUsed", Err: db.ErrShortBuffer}
+	}
+	r.GasUsed = binary.BigEndian.Uint64(buf.Next(8))
+
+	return nil
+}
+
+// Decode Receipt from bitbox format.
+func (r *Receipt) Decode(raw []byte) error {
+	return r.DecodeFrom(bytes.NewBuffer(raw))
+}
@@ -0,0 +1,48 @@
+// Package example holds types with generated bitbox methods, it's used
+// to check generated code against reflective encoding.
+package example
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+//go:generate go run bucketdb/cmd/bitboxgen -type Tx,Log,Receipt
+
+type Tx struct {
+	Type     uint8
+	Nonce    uint64
+	Gas      hexutil.Uint64
+	To       *common.Address
+	From     common.Address
+	Hash     common.Hash
+	Value    *big.Int
+	V, R, S  *big.Int
+	Data     []byte
+	Memo     string
+	Failed   bool
+	Fee      float64
+	Index    int
+	Delta    int16
+	Ids      []int32
+	Logs     []Log
+	Labels   map[string]string
+	internal int
+}
+
+type Log struct {
+	Address common.Address
+	Topics  []common.Hash
+	Data    []byte
+}
+
+type Receipt struct {
+	Status  uint64          `bitbox:"varint"`
+	TxHash  common.Hash     `bitbox:"fixed=32"`
+	To      *common.Address `bitbox:"optional"`
+	Bloom   []byte          `bitbox:"fixed=8"`
+	Cache   []byte          `bitbox:"-"`
+	GasUsed uint64
+}
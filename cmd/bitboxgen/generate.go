@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Fixed size basic types which are encoded inline.
+var fixed = map[string]struct {
+	size   int
+	encode string // %s is replaced with field expression
+	decode string // %s is replaced with buf.Next(size)
+}{
+	"bool":    {1, "", "%s[0] != 0"},
+	"int8":    {1, "buf.WriteByte(byte(%s))", "int8(%s[0])"},
+	"uint8":   {1, "buf.WriteByte(%s)", "%s[0]"},
+	"byte":    {1, "buf.WriteByte(%s)", "%s[0]"},
+	"int16":   {2, "buf.Write(binary.BigEndian.AppendUint16(buf.AvailableBuffer(), uint16(%s)))", "int16(binary.BigEndian.Uint16(%s))"},
+	"uint16":  {2, "buf.Write(binary.BigEndian.AppendUint16(buf.AvailableBuffer(), %s))", "binary.BigEndian.Uint16(%s)"},
+	"int32":   {4, "buf.Write(binary.BigEndian.AppendUint32(buf.AvailableBuffer(), uint32(%s)))", "int32(binary.BigEndian.Uint32(%s))"},
+	"uint32":  {4, "buf.Write(binary.BigEndian.AppendUint32(buf.AvailableBuffer(), %s))", "binary.BigEndian.Uint32(%s)"},
+	"int64":   {8, "buf.Write(binary.BigEndian.AppendUint64(buf.AvailableBuffer(), uint64(%s)))", "int64(binary.BigEndian.Uint64(%s))"},
+	"uint64":  {8, "buf.Write(binary.BigEndian.AppendUint64(buf.AvailableBuffer(), %s))", "binary.BigEndian.Uint64(%s)"},
+	"int":     {8, "buf.Write(binary.BigEndian.AppendUint64(buf.AvailableBuffer(), uint64(%s)))", "int(binary.BigEndian.Uint64(%s))"},
+	"uint":    {8, "buf.Write(binary.BigEndian.AppendUint64(buf.AvailableBuffer(), uint64(%s)))", "uint(binary.BigEndian.Uint64(%s))"},
+	"float32": {4, "buf.Write(binary.BigEndian.AppendUint32(buf.AvailableBuffer(), math.Float32bits(%s)))", "math.Float32frombits(binary.BigEndian.Uint32(%s))"},
+	"float64": {8, "buf.Write(binary.BigEndian.AppendUint64(buf.AvailableBuffer(), math.Float64bits(%s)))", "math.Float64frombits(binary.BigEndian.Uint64(%s))"},
+}
+
+// Byte array types from other packages which are encoded inline.
+var byteArrays = map[string]bool{
+	"github.com/ethereum/go-ethereum/common.Address": true,
+	"github.com/ethereum/go-ethereum/common.Hash":    true,
+}
+
+// Generator state for a single output file.
+type generator struct {
+	pkg *Package
+	buf bytes.Buffer
+
+	// Qualifier of the bitbox package, empty inside the package itself.
+	db string
+
+	imports map[string]bool
+
+	// Imports of the file with currently generated struct.
+	scope map[string]string
+}
+
+// Generate Encode/Decode methods for given struct types.
+func generate(pkg *Package, types []string) ([]byte, error) {
+	g := &generator{pkg: pkg, db: "db.", imports: map[string]bool{}}
+
+	if pkg.Path == bitboxPath {
+		g.db = ""
+	}
+
+	body := new(bytes.Buffer)
+
+	for _, name := range types {
+		st, ok := pkg.structs[name]
+		if !ok {
+			return nil, fmt.Errorf("struct %s not found in package %s", name, pkg.Name)
+		}
+
+		// Field IDs change layout of the whole struct, keep them in bitbox.
+		if hasIDs(st.Type) {
+			return nil, fmt.Errorf("struct %s uses field ids, which are supported only by reflective encoding", name)
+		}
+
+		g.buf.Reset()
+		g.scope = st.Imports
+		g.generate(name, st.Type)
+		body.Write(g.buf.Bytes())
+	}
+
+	out := new(bytes.Buffer)
+	fmt.Fprintf(out, "// Code generated by bitboxgen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(out, "package %s\n\n", pkg.Name)
+
+	if g.db != "" {
+		g.imports[bitboxPath] = true
+	}
+
+	// Standard library first, bitbox in separate group.
+	imports := []string{}
+	for path := range g.imports {
+		if path != bitboxPath {
+			imports = append(imports, path)
+		}
+	}
+	sort.Strings(imports)
+
+	if g.imports[bitboxPath] {
+		imports = append(imports, "", bitboxPath)
+	}
+
+	if len(imports) > 0 {
+		fmt.Fprintf(out, "import (\n")
+		for _, path := range imports {
+			if path == "" {
+				fmt.Fprintf(out, "\n")
+				continue
+			}
+			fmt.Fprintf(out, "\t%q\n", path)
+		}
+		fmt.Fprintf(out, ")\n\n")
+	}
+
+	out.Write(body.Bytes())
+
+	src, err := format.Source(out.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("format generated code: %w\n%s", err, out.Bytes())
+	}
+
+	return src, nil
+}
+
+// Exported fields of struct, in order of declaration.
+func fields(st *ast.StructType) []*ast.Field {
+	list := []*ast.Field{}
+
+	for _, f := range st.Fields.List {
+		names := f.Names
+
+		// Embedded field, its name is the name of the type.
+		if len(names) == 0 {
+			names = []*ast.Ident{ast.NewIdent(typeName(f.Type))}
+		}
+
+		// Fields tagged with bitbox:"-" are skipped, same as in reflective encoding.
+		if slices.Contains(strings.Split(bitboxTag(f), ","), "-") {
+			continue
+		}
+
+		for _, name := range names {
+			if name.IsExported() {
+				list = append(list, &ast.Field{Names: []*ast.Ident{name}, Type: f.Type, Tag: f.Tag})
+			}
+		}
+	}
+
+	return list
+}
+
+// Check if any field of struct has bitbox id tag.
+func hasIDs(st *ast.StructType) bool {
+	for _, f := range fields(st) {
+		for _, opt := range strings.Split(bitboxTag(f), ",") {
+			if strings.HasPrefix(opt, "id=") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Get bitbox struct tag of the field.
+func bitboxTag(f *ast.Field) string {
+	if f.Tag == nil {
+		return ""
+	}
+
+	tag, err := strconv.Unquote(f.Tag.Value)
+	if err != nil {
+		return ""
+	}
+
+	return reflect.StructTag(tag).Get("bitbox")
+}
+
+func typeName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		return t.Name
+	case *ast.StarExpr:
+		return typeName(t.X)
+	case *ast.SelectorExpr:
+		return t.Sel.Name
+	case *ast.IndexExpr:
+		return typeName(t.X)
+	}
+
+	return ""
+}
+
+func (g *generator) generate(name string, st *ast.StructType) {
+	fields := fields(st)
+	recv := receiver(name)
+	g.imports["bytes"] = true
+
+	// Encode.
+	size := 0
+	for _, f := range fields {
+		size += g.sizeHint(f.Type)
+	}
+
+	g.printf("// Encode %s appending it to buf.\n", name)
+	g.printf("func (%s *%s) EncodeTo(buf *bytes.Buffer) error {\n", recv, name)
+
+	for _, f := range fields {
+		g.encodeField(recv+"."+f.Names[0].Name, bitboxTag(f), f.Type)
+	}
+
+	g.printf("return nil\n}\n\n")
+
+	g.printf("// Encode %s into bitbox format.\n", name)
+	g.printf("func (%s *%s) Encode() ([]byte, error) {\n", recv, name)
+	g.printf("buf := bytes.NewBuffer(make([]byte, 0, %d))\n\n", size)
+	g.printf("err := %s.EncodeTo(buf)\nif err != nil {\nreturn nil, err\n}\n\n", recv)
+	g.printf("return buf.Bytes(), nil\n}\n\n")
+
+	// Decode.
+	g.printf("// Decode %s from buf.\n", name)
+	g.printf("func (%s *%s) DecodeFrom(buf *bytes.Buffer) error {\n", recv, name)
+
+	for _, f := range fields {
+		path := g.pkg.Name + "." + name + "." + f.Names[0].Name
+		g.decodeField(recv+"."+f.Names[0].Name, path, bitboxTag(f), f.Type)
+	}
+
+	g.printf("return nil\n}\n\n")
+
+	g.printf("// Decode %s from bitbox format.\n", name)
+	g.printf("func (%s *%s) Decode(raw []byte) error {\n", recv, name)
+	g.printf("return %s.DecodeFrom(bytes.NewBuffer(raw))\n}\n\n", recv)
+}
+
+func (g *generator) encodeField(field, tag string, expr ast.Expr) {
+	switch {
+	case tag != "":
+		// Tagged fields are handled by bitbox itself.
+		g.printf("if err := %sEncodeField(buf, %s, %q); err != nil {\nreturn err\n}\n", g.db, field, tag)
+
+	case isFixed(expr):
+		name := expr.(*ast.Ident).Name
+		g.uses(fixed[name].encode)
+
+		if name == "bool" {
+			g.printf("if %s {\nbuf.WriteByte(1)\n} else {\nbuf.WriteByte(0)\n}\n", field)
+			break
+		}
+		g.printf(fixed[name].encode+"\n", field)
+
+	case isIdent(expr, "string"):
+		g.imports["encoding/binary"] = true
+		g.printf("buf.Write(binary.BigEndian.AppendUint64(buf.AvailableBuffer(), uint64(len(%s))))\n", field)
+		g.printf("buf.WriteString(%s)\n", field)
+
+	case isByteSlice(expr):
+		g.imports["encoding/binary"] = true
+		g.printf("buf.Write(binary.BigEndian.AppendUint64(buf.AvailableBuffer(), uint64(len(%s))))\n", field)
+		g.printf("buf.Write(%s)\n", field)
+
+	case isByteArray(expr) || g.isKnownArray(expr):
+		g.printf("buf.Write(%s[:])\n", field)
+
+	case isBigIntPtr(expr):
+		g.imports["encoding/binary"] = true
+		g.printf("{\nvar raw []byte\nif %s != nil {\nraw = %s.Bytes()\n}\n", field, field)
+		g.printf("buf.Write(binary.BigEndian.AppendUint64(buf.AvailableBuffer(), uint64(len(raw))))\n")
+		g.printf("buf.Write(raw)\n}\n")
+
+	default:
+		g.printf("if err := %sEncodeTo(buf, %s); err != nil {\nreturn err\n}\n", g.db, field)
+	}
+
+	g.printf("\n")
+}
+
+func (g *generator) decodeField(field, path, tag string, expr ast.Expr) {
+	switch {
+	case tag != "":
+		g.printf("if err := %sDecodeField(buf, &%s, %q); err != nil {\nreturn err\n}\n", g.db, field, tag)
+
+	case isFixed(expr):
+		f := fixed[expr.(*ast.Ident).Name]
+		g.uses(f.decode)
+
+		g.shortBuffer(fmt.Sprint(f.size), path)
+		g.printf("%s = "+f.decode+"\n", field, fmt.Sprintf("buf.Next(%d)", f.size))
+
+	case isByteArray(expr) || g.isKnownArray(expr):
+		g.shortBuffer("len("+field+")", path)
+		g.printf("copy(%s[:], buf.Next(len(%s)))\n", field, field)
+
+	default:
+		g.printf("if err := %sDecode(buf, &%s); err != nil {\nreturn err\n}\n", g.db, field)
+	}
+
+	g.printf("\n")
+}
+
+func (g *generator) shortBuffer(size, path string) {
+	g.printf("if buf.Len() < %s {\n", size)
+	g.printf("return &%sDecodeError{Path: %q, Err: %sErrShortBuffer}\n}\n", g.db, path, g.db)
+}
+
+// Guess encoded size of field, used as initial capacity.
+func (g *generator) sizeHint(expr ast.Expr) int {
+	if isFixed(expr) {
+		return fixed[expr.(*ast.Ident).Name].size
+	}
+
+	if g.isKnownArray(expr) {
+		return 32
+	}
+
+	return 8
+}
+
+// Register imports used by code snippet.
+func (g *generator) uses(snippet string) {
+	if bytes.Contains([]byte(snippet), []byte("binary.")) {
+		g.imports["encoding/binary"] = true
+	}
+
+	if bytes.Contains([]byte(snippet), []byte("math.")) {
+		g.imports["math"] = true
+	}
+}
+
+// Check if expr is a known byte array from other package, ex: common.Hash.
+func (g *generator) isKnownArray(expr ast.Expr) bool {
+	sel, ok := expr.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+
+	pkg, ok := sel.X.(*ast.Ident)
+	if !ok {
+		return false
+	}
+
+	return byteArrays[g.scope[pkg.Name]+"."+sel.Sel.Name]
+}
+
+func (g *generator) printf(format string, args ...any) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// Receiver name, lowercase first letter of the type.
+func receiver(name string) string {
+	return string(bytes.ToLower([]byte(name[:1])))
+}
+
+func isIdent(expr ast.Expr, name string) bool {
+	ident, ok := expr.(*ast.Ident)
+	return ok && ident.Name == name
+}
+
+func isFixed(expr ast.Expr) bool {
+	ident, ok := expr.(*ast.Ident)
+	if !ok {
+		return false
+	}
+
+	_, ok = fixed[ident.Name]
+	return ok
+}
+
+func isByte(expr ast.Expr) bool {
+	return isIdent(expr, "byte") || isIdent(expr, "uint8")
+}
+
+func isByteSlice(expr ast.Expr) bool {
+	arr, ok := expr.(*ast.ArrayType)
+	return ok && arr.Len == nil && isByte(arr.Elt)
+}
+
+func isByteArray(expr ast.Expr) bool {
+	arr, ok := expr.(*ast.ArrayType)
+	if !ok || arr.Len == nil || !isByte(arr.Elt) {
+		return false
+	}
+
+	// Skip [...]byte, it's not valid in struct fields anyway.
+	_, ellipsis := arr.Len.(*ast.Ellipsis)
+	return !ellipsis
+}
+
+func isBigIntPtr(expr ast.Expr) bool {
+	star, ok := expr.(*ast.StarExpr)
+	if !ok {
+		return false
+	}
+
+	sel, ok := star.X.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+
+	pkg, ok := sel.X.(*ast.Ident)
+	return ok && pkg.Name == "big" && sel.Sel.Name == "Int"
+}
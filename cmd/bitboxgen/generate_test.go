@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bucketdb/tests"
+	"bytes"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func parseSource(t *testing.T, path, src string) *Package {
+	f, err := parser.ParseFile(token.NewFileSet(), "src.go", src, 0)
+	tests.Assert(t, nil, err)
+
+	pkg := &Package{Name: f.Name.Name, Path: path, structs: map[string]*Struct{}}
+	for name, st := range structs(f) {
+		pkg.structs[name] = &Struct{Type: st, Imports: imports(f)}
+	}
+
+	return pkg
+}
+
+// Generated example must be up to date.
+func TestGenerateExample(t *testing.T) {
+	dir := "example"
+	output := filepath.Join(dir, "tx_bitbox.go")
+
+	pkg, err := parsePackage(dir, output)
+	tests.Assert(t, nil, err)
+	tests.Assert(t, "bucketdb/cmd/bitboxgen/example", pkg.Path)
+
+	src, err := generate(pkg, []string{"Tx", "Log", "Receipt"})
+	tests.Assert(t, nil, err)
+
+	current, err := os.ReadFile(output)
+	tests.Assert(t, nil, err)
+	tests.Assert(t, true, bytes.Equal(current, src))
+}
+
+// Inside the bitbox package itself generated code can't import it.
+func TestGenerateBitboxPackage(t *testing.T) {
+	pkg := parseSource(t, bitboxPath, `package db
+
+import "github.com/ethereum/go-ethereum/common"
+
+type Item struct {
+	Id    uint64
+	Owner *common.Address
+}`)
+
+	src, err := generate(pkg, []string{"Item"})
+	tests.Assert(t, nil, err)
+
+	code := string(src)
+	tests.Assert(t, false, strings.Contains(code, `"bucketdb/db"`))
+	tests.Assert(t, false, strings.Contains(code, "db.Decode"))
+	tests.Assert(t, true, strings.Contains(code, "EncodeTo(buf, i.Owner)"))
+	tests.Assert(t, true, strings.Contains(code, "Decode(buf, &i.Owner)"))
+}
+
+func TestGenerateUnknownType(t *testing.T) {
+	pkg := parseSource(t, "example", "package example\n\ntype Item struct{}")
+
+	_, err := generate(pkg, []string{"Missing"})
+	tests.Assert(t, true, err != nil)
+}
+
+func TestGenerateFieldIDs(t *testing.T) {
+	pkg := parseSource(t, "example", "package example\n\ntype Item struct {\nId uint64 `bitbox:\"id=1\"`\n}")
+
+	_, err := generate(pkg, []string{"Item"})
+	tests.Assert(t, true, err != nil)
+}
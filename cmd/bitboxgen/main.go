@@ -0,0 +1,64 @@
+// Bitboxgen generates EncodeTo and DecodeFrom methods for structs, so hot
+// types don't have to go through reflection, with Encode and Decode as
+// wrappers. Generated methods produce the same bytes as reflective
+// db.Encode of struct fields, db.Encode and db.Decode use them in place
+// of reflection (in DefaultMode only), so values stored before code was
+// generated stay readable.
+//
+// Usage, in the file with struct definitions:
+//
+//	//go:generate go run bucketdb/cmd/bitboxgen -type Tx,Receipt
+//
+// Fixed size numbers, bools, strings, []byte, byte arrays and *big.Int
+// are encoded inline. Fields with bitbox tags go through db.EncodeField and
+// db.DecodeField, all other fields fall back to db.EncodeTo/db.Decode.
+// Structs with field IDs (`bitbox:"id=N"`) are not supported.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	types := flag.String("type", "", "comma separated list of struct names")
+	output := flag.String("output", "", "output file, default: <type>_bitbox.go")
+	flag.Parse()
+
+	if *types == "" {
+		fmt.Fprintln(os.Stderr, "bitboxgen: -type is required")
+		os.Exit(2)
+	}
+
+	dir := "."
+	if flag.NArg() > 0 {
+		dir = flag.Arg(0)
+	}
+
+	names := strings.Split(*types, ",")
+
+	if *output == "" {
+		*output = filepath.Join(dir, strings.ToLower(names[0])+"_bitbox.go")
+	}
+
+	pkg, err := parsePackage(dir, *output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bitboxgen:", err)
+		os.Exit(1)
+	}
+
+	src, err := generate(pkg, names)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bitboxgen:", err)
+		os.Exit(1)
+	}
+
+	err = os.WriteFile(*output, src, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bitboxgen:", err)
+		os.Exit(1)
+	}
+}
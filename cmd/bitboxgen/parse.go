@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Import path of the bitbox codec.
+const bitboxPath = "bucketdb/db"
+
+// Parsed package with struct definitions.
+type Package struct {
+	Name string
+	Path string
+
+	structs map[string]*Struct
+}
+
+// Struct definition with imports of its file, so we can resolve
+// types from other packages.
+type Struct struct {
+	Type    *ast.StructType
+	Imports map[string]string // name -> path
+}
+
+// Parse all non test files in dir, skipping the output file.
+func parsePackage(dir, output string) (*Package, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+
+	fset := token.NewFileSet()
+	pkg := &Package{structs: map[string]*Struct{}}
+
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") || filepath.Clean(file) == filepath.Clean(output) {
+			continue
+		}
+
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		pkg.Name = f.Name.Name
+		imports := imports(f)
+
+		for name, st := range structs(f) {
+			pkg.structs[name] = &Struct{Type: st, Imports: imports}
+		}
+	}
+
+	if pkg.Name == "" {
+		return nil, fmt.Errorf("no go files in %s", dir)
+	}
+
+	pkg.Path, err = importPath(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return pkg, nil
+}
+
+// Get all struct type definitions from file.
+func structs(f *ast.File) map[string]*ast.StructType {
+	found := map[string]*ast.StructType{}
+
+	ast.Inspect(f, func(n ast.Node) bool {
+		spec, ok := n.(*ast.TypeSpec)
+		if !ok {
+			return true
+		}
+
+		if st, ok := spec.Type.(*ast.StructType); ok {
+			found[spec.Name.Name] = st
+		}
+		return false
+	})
+
+	return found
+}
+
+// Get imports of file by the name they are used with.
+func imports(f *ast.File) map[string]string {
+	found := map[string]string{}
+
+	for _, spec := range f.Imports {
+		path := strings.Trim(spec.Path.Value, `"`)
+		name := path[strings.LastIndex(path, "/")+1:]
+
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+
+		found[name] = path
+	}
+
+	return found
+}
+
+// Find import path of dir using the closest go.mod.
+func importPath(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for root := dir; ; root = filepath.Dir(root) {
+		module, err := modulePath(filepath.Join(root, "go.mod"))
+		if err == nil {
+			rel, err := filepath.Rel(root, dir)
+			if err != nil {
+				return "", err
+			}
+			return filepath.ToSlash(filepath.Join(module, rel)), nil
+		}
+
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+
+		if filepath.Dir(root) == root {
+			return "", fmt.Errorf("go.mod not found for %s", dir)
+		}
+	}
+}
+
+func modulePath(gomod string) (string, error) {
+	f, err := os.Open(gomod)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "module ") {
+			return strings.Trim(strings.TrimSpace(line[len("module "):]), `"`), nil
+		}
+	}
+
+	return "", fmt.Errorf("module path missing in %s", gomod)
+}
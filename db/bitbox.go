@@ -3,8 +3,9 @@ package db
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"math/big"
+	"io"
 	"reflect"
 	"unsafe"
 )
@@ -21,205 +22,279 @@ type Decoder interface {
 	Decode([]byte) error
 }
 
-// **************
-//     Encode
-// **************
+// Methods generated by bitboxgen. They write and read struct fields
+// in place, without length prefix, so values have the same layout as
+// with reflection. Used only in DefaultMode, have priority over Encoder
+// and Decoder.
+type generated interface {
+	EncodeTo(*bytes.Buffer) error
+	DecodeFrom(*bytes.Buffer) error
+}
 
-func Encode(elements ...any) (*bytes.Buffer, error) {
-	buf := new(bytes.Buffer)
+// ***************
+//  Decode errors
+// ***************
+
+var (
+	ErrUnsupportedType = errors.New("unsupported type")
+	ErrShortBuffer     = errors.New("short buffer")
+	ErrLengthLimit     = errors.New("length over limit")
+	ErrInvalidData     = errors.New("invalid data")
+	ErrInvalidTag      = errors.New("invalid bitbox tag")
+	ErrFixedLength     = errors.New("length differs from fixed size")
+)
 
-	for _, elem := range elements {
-		val := reflect.ValueOf(elem)
+// Maximum number of elements in decoded slice, map or string, unless
+// set otherwise with Decoding.
+const DefaultMaxSliceLen = 1 << 24
 
-		if isPointer(val) && isStruct(val.Elem()) {
-			if isEncoder(val) {
-				structEncode(buf, val)
-			}
-			continue
-		}
+// DecodeError describes where decoding failed.
+type DecodeError struct {
+	// Path to the failed field, ex: Tx.Ids[2].
+	Path string
+	Err  error
 
-		val = reflect.Indirect(val)
+	// Additional info, ex: unsupported type or decoded length.
+	Detail any
+}
 
-		// Encode structs.
-		if isStruct(val) {
-			// Using Encoder() interface.
-			if isEncoder(val) {
-				structEncode(buf, val)
-				continue
-			}
+func (e *DecodeError) Error() string {
+	if e.Detail != nil {
+		return fmt.Sprintf("bitbox: %s: %v (%v)", e.Path, e.Err, e.Detail)
+	}
 
-			// Encode all fields in struct.
-			encodeStructFields(buf, elem)
-			continue
-		}
+	return fmt.Sprintf("bitbox: %s: %v", e.Path, e.Err)
+}
 
-		// Encode slices, arrays and basic types.
-		encode(buf, val)
-	}
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
 
-	return buf, nil
+// Create error without path, path is prefixed on the way up.
+func decodeErr(err error, detail any) error {
+	return &DecodeError{Err: err, Detail: detail}
 }
 
-func structEncode(buf *bytes.Buffer, v reflect.Value) {
-	val := v.Interface().(Encoder)
-	bytes := reflect.ValueOf(val.Encode())
-	encode(buf, bytes)
+// EncodeError describes which value couldn't be encoded.
+type EncodeError struct {
+	// Path to the failed field, ex: Tx.Ids[2].
+	Path string
+	Err  error
+
+	// Additional info, ex: unsupported type.
+	Detail any
 }
 
-func encodeStructFields(buf *bytes.Buffer, elem any) error {
-	val := reflect.ValueOf(elem)
+func (e *EncodeError) Error() string {
+	if e.Detail != nil {
+		return fmt.Sprintf("bitbox: %s: %v (%v)", e.Path, e.Err, e.Detail)
+	}
+
+	return fmt.Sprintf("bitbox: %s: %v", e.Path, e.Err)
+}
 
-	for i := 0; i < val.NumField(); i++ {
-		fv := val.Field(i)
+func (e *EncodeError) Unwrap() error {
+	return e.Err
+}
 
-		if isPointer(fv) && fv.IsNil() {
-			encodeEmptyCollection(buf, fv)
-			continue
-		}
+func encodeErr(err error, detail any) error {
+	return &EncodeError{Err: err, Detail: detail}
+}
 
-		encode(buf, fv)
+// Prefix path of encode/decode error with given segment. Paths are
+// built only when something fails, so successful calls don't pay
+// for them.
+func prefixErr(err error, segment string) error {
+	switch e := err.(type) {
+	case *DecodeError:
+		e.Path = segment + e.Path
+	case *EncodeError:
+		e.Path = segment + e.Path
 	}
 
-	return nil
+	return err
 }
 
-// Encode empty (nil) slice, array.
-func encodeEmptyCollection(buf *bytes.Buffer, val reflect.Value) {
-	kind := val.Type().Kind()
+// ***************
+//  Encoding mode
+// ***************
+
+// Encoding mode, modes can be combined, ex: Varint|LittleEndian.
+//
+// Encode doesn't store mode in encoded bytes, values must be decoded in
+// the same mode they were encoded with. To record it, write a mode header
+// before values with EncodeHeader and read it back with ReadMode (stream
+// encoders and decoders have WriteHeader and ReadHeader). Keys keep mode
+// in record flags.
+type Mode uint8
+
+const (
+	// Big endian numbers and int64 length prefixes.
+	DefaultMode Mode = 0
+
+	// Unsigned varint length prefixes, saves 7 bytes on short slices.
+	Varint Mode = 1 << 0
+
+	// Little endian fixed size numbers, native byte order on amd64.
+	LittleEndian Mode = 1 << 1
+
+	// Decode []byte and *[N]byte without copying, see DecodeView.
+	// Doesn't change encoding.
+	View Mode = 1 << 2
+
+	// Write empty, non-nil slices and maps with length -1 (all bits set,
+	// also in Varint mode), so they decode as empty instead of nil.
+	KeepEmpty Mode = 1 << 3
+)
+
+// Mode header byte: magic in the high bits, encoding modes in the low
+// ones. View only changes decoding, so it isn't stored.
+const (
+	modeMagic  = 0xb0
+	modeMask   = Varint | LittleEndian | KeepEmpty
+	headerMask = 0xf0
+)
+
+var ErrModeHeader = errors.New("invalid mode header")
 
-	if isPointer(val) {
-		kind = val.Type().Elem().Kind()
+// Write mode header, see ReadMode.
+func (m Mode) EncodeHeader(buf *bytes.Buffer) {
+	buf.WriteByte(modeMagic | byte(m&modeMask))
+}
+
+// Read mode header written by EncodeHeader. Values following it must
+// be decoded in returned mode.
+func ReadMode(buf *bytes.Buffer) (Mode, error) {
+	b, err := buf.ReadByte()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrModeHeader, ErrShortBuffer)
 	}
 
-	if kind == reflect.Struct {
-		// TODO: handle all this types in one custom function.
-		if isBigInt(val.Type().Elem()) {
-			size := int64(0)
-			write(buf, &size)
-		}
+	return parseMode(b)
+}
+
+func parseMode(b byte) (Mode, error) {
+	if b&headerMask != modeMagic || Mode(b)&^headerMask&^modeMask != 0 {
+		return 0, fmt.Errorf("%w: %#x", ErrModeHeader, b)
 	}
 
-	// For empty array we must create one and fill buffer with it's default values.
-	// We are not adding size for arrays, decoder should now the size.
-	if kind == reflect.Array {
-		elem := createElem(val)
-		write(buf, elem.Interface())
+	return Mode(b) & modeMask, nil
+}
+
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+func (m Mode) order() byteOrder {
+	if m&LittleEndian != 0 {
+		return binary.LittleEndian
 	}
 
-	// For empty slice we only write size 0.
-	if kind == reflect.Slice {
-		size := int64(0)
-		write(buf, &size)
+	return binary.BigEndian
+}
+
+// Name of the type used as a root of decode paths.
+func typeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
 	}
+
+	return t.String()
 }
 
-func encode(buf *bytes.Buffer, val reflect.Value) {
-	// Get rid of pointers, use values.
-	val = reflect.Indirect(val)
-
-	// Encode arrays and structs.
-	if isArray(val.Type()) || isSlice(val) {
-		switch val.Type().Elem().Kind() {
-		case reflect.Uint8:
-			encodeSlice[uint8](buf, val)
-		case reflect.Uint16:
-			encodeSlice[uint16](buf, val)
-		case reflect.Uint32:
-			encodeSlice[uint32](buf, val)
-		case reflect.Uint64:
-			encodeSlice[uint64](buf, val)
-		case reflect.Int8:
-			encodeSlice[int8](buf, val)
-		case reflect.Int16:
-			encodeSlice[int16](buf, val)
-		case reflect.Int32:
-			encodeSlice[int32](buf, val)
-		case reflect.Int64:
-			encodeSlice[int64](buf, val)
-		case reflect.Float32:
-			encodeSlice[float32](buf, val)
-		case reflect.Float64:
-			encodeSlice[float64](buf, val)
-
-		default:
-			// We have slice with structs, let's iterate.
-			// TODO: Clean this section, possible bugs.
-			write(buf, int64(val.Len()))
-
-			for i := 0; i < val.Len(); i++ {
-				elem := val.Index(i)
-				if isEncoder(elem) {
-					bytes := elem.Interface().(Encoder)
-					encode(buf, reflect.ValueOf(bytes.Encode()))
-				}
-			}
-		}
+// **************
+//     Encode
+// **************
+
+// Encode elements one after another.
+//
+// Layout of supported kinds:
+//
+//	numerics     fixed size, big endian (int and uint as 64 bit)
+//	bool         1 byte
+//	string       int64 length | bytes
+//	slice        int64 length | elements
+//	array        elements (length is known from the type)
+//	map          int64 length | key, value pairs sorted by encoded key
+//	struct       exported fields in order of declaration
+//	struct (IDs) int64 count | (uvarint id | int64 length | field)...
+//	big.Int      int64 length | absolute value bytes (also hexutil.Big)
+//	Encoder      int64 length | Encode() bytes
+//	bitboxgen    same as struct, see cmd/bitboxgen
+//
+// Nil and empty slices and maps are written with length 0 and decoded
+// as nil, see KeepEmpty to keep them apart. Pointers are encoded as values
+// they point to, nil pointers as zero values, use optional tag to keep
+// them nil.
+func Encode(elements ...any) (*bytes.Buffer, error) {
+	return DefaultMode.Encode(elements...)
+}
+
+// Encode elements appending them to buf.
+func EncodeTo(buf *bytes.Buffer, elements ...any) error {
+	return DefaultMode.EncodeTo(buf, elements...)
+}
+
+// Encode single value with bitbox tag options, ex: "optional,varint".
+// Used by generated code for tagged fields.
+func EncodeField(buf *bytes.Buffer, elem any, tag string) error {
+	return DefaultMode.EncodeField(buf, elem, tag)
+}
+
+// Encode elements in given mode.
+func (m Mode) Encode(elements ...any) (*bytes.Buffer, error) {
+	buf := new(bytes.Buffer)
+
+	err := m.EncodeTo(buf, elements...)
+	if err != nil {
+		return nil, err
 	}
 
-	if isStruct(val) {
-		// Special case for big.Int
-		if isBigInt(val.Type()) {
-			bigint := val.Interface().(big.Int)
-			encodeSlice[uint8](buf, reflect.ValueOf(bigint.Bytes()))
+	return buf, nil
+}
+
+// Encode elements in given mode appending them to buf.
+func (m Mode) EncodeTo(buf *bytes.Buffer, elements ...any) error {
+	for _, elem := range elements {
+		err := m.encode(buf, elem, "")
+		if err != nil {
+			return err
 		}
 	}
 
-	// Encode single types.
-	switch val.Kind() {
-	case reflect.Uint8:
-		write(buf, val.Interface())
-	case reflect.Uint16:
-		write(buf, val.Interface())
-	case reflect.Uint32:
-		write(buf, val.Interface())
-	case reflect.Uint64:
-		write(buf, val.Interface())
-	case reflect.Int8:
-		write(buf, val.Interface())
-	case reflect.Int16:
-		write(buf, val.Interface())
-	case reflect.Int32:
-		write(buf, val.Interface())
-	case reflect.Int64:
-		write(buf, val.Interface())
-	case reflect.Float32:
-		write(buf, val.Interface())
-	case reflect.Float64:
-		write(buf, val.Interface())
-	}
+	return nil
 }
 
-func encodeSlice[T any](buf *bytes.Buffer, val reflect.Value) {
-	// TODO: Handle nil and empty collections
-	if val.Len() == 0 {
-		write(buf, int64(0))
-		return
-	}
+// Encode single value in given mode with bitbox tag options.
+func (m Mode) EncodeField(buf *bytes.Buffer, elem any, tag string) error {
+	return m.encode(buf, elem, tag)
+}
 
-	// If we have array, we know the number of elements so we
-	// don't have to write them to buffer. Decoder should
-	// know the exact type.
-	if !isArray(val.Type()) {
-		write(buf, int64(val.Len()))
+func (m Mode) encode(buf *bytes.Buffer, elem any, tag string) error {
+	val := reflect.ValueOf(elem)
+	if !val.IsValid() {
+		return prefixErr(encodeErr(ErrUnsupportedType, nil), "nil")
 	}
 
-	if !isPointer(val) {
-		binary.Write(buf, binary.BigEndian, val.Interface())
-		return
+	typ := val.Type()
+
+	// Codecs expect addressable structs and arrays.
+	if kind := val.Kind(); kind == reflect.Struct || kind == reflect.Array {
+		val = addressable(val)
 	}
 
-	// [OLD] Slower but safer.
-	// binary.Write(buf, binary.BigEndian, ar.Slice(0, ar.Len()).Interface().([]int8))
-	//
-	// [NEW] Unsafe but faster.
-	ptr := unsafe.Pointer(val.Index(0).Addr().UnsafePointer())
-	slice := unsafe.Slice((*T)(ptr), val.Len())
+	c := codecOf(typ, m, DefaultMaxSliceLen)
+	if tag != "" {
+		c = taggedCodecOf(typ, m, DefaultMaxSliceLen, tag)
+	}
 
-	binary.Write(buf, binary.BigEndian, slice)
-}
+	err := c.encode(buf, val)
+	if err != nil {
+		return prefixErr(err, typeName(typ))
+	}
 
-func write(buf *bytes.Buffer, elem any) error {
-	return binary.Write(buf, binary.BigEndian, elem)
+	return nil
 }
 
 // ********
@@ -253,230 +328,106 @@ func PointTo[T any](obj **T, data []byte) {
 	*obj = (*T)(unsafe.Pointer(&data[0]))
 }
 
+// Decode items one after another, each item must be a pointer.
+// See Encode for the layout of supported kinds.
 func Decode(buf *bytes.Buffer, items ...any) error {
-	for _, item := range items {
-		elem := reflect.TypeOf(item)
-		val := reflect.ValueOf(item)
-
-		if isSlicePtr(item) {
-			elem = elem.Elem().Elem()
-			switch elem.Kind() {
-			case reflect.Uint8:
-				decodeSlice[uint8](buf, item)
-			case reflect.Uint16:
-				decodeSlice[uint16](buf, item)
-			case reflect.Uint64:
-				decodeSlice[uint64](buf, item)
-			case reflect.Uint32:
-				decodeSlice[uint32](buf, item)
-			case reflect.Int64:
-				decodeSlice[int64](buf, item)
-			case reflect.Int32:
-				decodeSlice[int32](buf, item)
-			case reflect.Int16:
-				decodeSlice[int16](buf, item)
-			case reflect.Int8:
-				decodeSlice[int8](buf, item)
-			case reflect.Float64:
-				decodeSlice[float64](buf, item)
-			case reflect.Float32:
-				decodeSlice[float32](buf, item)
-
-			default:
-				// Check if we have slice of structs.
-				if isStruct(reflect.ValueOf(val.Elem())) {
-					decodeArrayStruct(buf, val, item)
-					continue
-				}
-
-				fmt.Printf("unsupported type: %v\n", elem.Kind())
-			}
-
-			continue
-		}
-
-		if isStruct(reflect.Indirect(val)) {
-			val, ok := val.Interface().(Decoder)
-			if ok {
-				val.Decode(buf.Bytes())
-				continue
-			}
-
-			decodeStructFields(buf, item)
-			continue
-		}
-
-		// Decode big.Int.
-		// TODO: Clean this.
-		val = reflect.Indirect(val)
-		if isPointer(val) {
-			if isBigInt(val.Elem().Type()) {
-				tmp := []byte{}
-				decodeSlice[uint8](buf, &tmp)
-
-				bigint := new(big.Int).SetBytes(tmp)
-				val.Elem().Set(reflect.ValueOf(*bigint))
-				continue
-			}
-		}
-
-		decode(buf, item)
-	}
-
-	return nil
+	return DefaultMode.Decode(buf, items...)
 }
 
-func decodeStructFields(buf *bytes.Buffer, dst any) {
-	val := reflect.ValueOf(dst)
-	val = reflect.Indirect(val)
-
-	for i := 0; i < val.NumField(); i++ {
-		field := val.Field(i)
-
-		if isPointer(field) && field.IsNil() {
-			elem := createElem(field)
-
-			if isArray(field.Type().Elem()) {
-				decode(buf, elem.Interface())
-				field.Set(elem)
-			}
-
-			if isBigInt(elem.Type().Elem()) {
-				tmp := []byte{}
-				decodeSlice[uint8](buf, &tmp)
-
-				bigint := elem.Interface().(*big.Int)
-				bigint.SetBytes(tmp)
-				field.Set(reflect.ValueOf(bigint))
-			}
-		}
-
-		if !isPointer(field) {
-			if isSlice(field) {
-				size := int64(0)
-				decode(buf, &size)
-
-				// Slice size is 0, there are no elements so we can continue with next field.
-				if size == 0 {
-					continue
-				}
-
-				// Fast path for []byte.
-				if field.Type().Elem().Kind() == reflect.Uint8 {
-					tmp := make([]byte, size)
-					buf.Read(tmp)
-					field.SetBytes(tmp[:])
-					continue
-				}
-
-				decodeSlice2(buf, field, size)
-				continue
-			}
-
-			elem := createElem(field)
-			decode(buf, elem.Interface())
-			elem = elem.Elem()
-
-			field.Set(elem)
-		}
-	}
+// Decode items without copying bytes out of buf. []byte values are
+// slices of buf and *[N]byte pointers point into it (like PointTo),
+// all other values, byte arrays included, are copied as in Decode.
+//
+// Views are valid only as long as buf's bytes aren't changed or reused:
+//
+//   - values returned by Keys.Get are allocated per call, views into
+//     them can be kept as long as the value isn't modified,
+//   - views into mmaped regions are valid until region is unmapped or
+//     resized, writes to the file are visible through them,
+//   - views into reused buffers (ex: bytes.Buffer after Reset) must not
+//     outlive the next write.
+//
+// Views have capacity limited to their length, so appending to them
+// never overwrites buf.
+func DecodeView(buf *bytes.Buffer, items ...any) error {
+	return (DefaultMode | View).Decode(buf, items...)
 }
 
-func createElem(val reflect.Value) reflect.Value {
-	typ := val.Type()
-
-	if isPointer(val) {
-		typ = typ.Elem()
-	}
-
-	elem := reflect.New(typ)
-	return elem
+// Decode single value encoded with EncodeField using the same tag.
+func DecodeField(buf *bytes.Buffer, item any, tag string) error {
+	return DefaultMode.DecodeField(buf, item, tag)
 }
 
-// TODO: Temporary only, will be refactor.
-func decodeSlice2(buf *bytes.Buffer, val reflect.Value, size int64) {
-	typ := val.Type().Elem()
-	elem := reflect.MakeSlice(reflect.SliceOf(typ), int(size), int(size))
-
-	decode(buf, elem.Interface())
-	val.Set(elem)
+// Decode items encoded in given mode.
+func (m Mode) Decode(buf *bytes.Buffer, items ...any) error {
+	return Decoding{Mode: m}.Decode(buf, items...)
 }
 
-func decodeSlice[T any](buf *bytes.Buffer, dst any) {
-	// Decode slice size.
-	size := int64(0)
-	decode(buf, &size)
-
-	// Make temporary slice with proper size and write buffer data into it.
-	tmp := make([]T, size)
-	decode(buf, &tmp)
-
-	val1 := reflect.ValueOf(dst)
-	val2 := reflect.ValueOf(tmp)
-
-	// Set destination slice.
-	val1.Elem().Set(val2)
+// Decode single value encoded in given mode with bitbox tag options.
+func (m Mode) DecodeField(buf *bytes.Buffer, item any, tag string) error {
+	return m.decode(buf, item, tag)
 }
 
-func decode(buf *bytes.Buffer, dst any) error {
-	return binary.Read(buf, binary.BigEndian, dst)
+func (m Mode) decode(buf *bytes.Buffer, item any, tag string) error {
+	return Decoding{Mode: m}.decode(buf, item, tag)
 }
 
-func decodeArrayStruct(buf *bytes.Buffer, val reflect.Value, item any) {
-	elemType := reflect.TypeOf(item).Elem().Elem().Elem()
-	slice := val.Elem()
+// Decoding settings, for limits other than the default ones, ex:
+//
+//	Decoding{Mode: Varint, MaxSliceLen: 1024}.Decode(buf, &tx)
+type Decoding struct {
+	Mode Mode
 
-	// Get the number of elements in slice. Each element is also a slice.
-	// ex: []byte{[]byte, []byte, ...}
-	size := int64(0)
-	decode(buf, &size)
-
-	for i := int64(0); i < size; i++ {
-		bytes := make([]byte, size)
-		decodeSlice[uint8](buf, &bytes)
-
-		elem, _ := reflect.New(elemType).Interface().(Decoder)
-		elem.Decode(bytes)
+	// Maximum number of elements in decoded slice, map or string, longer
+	// ones fail with ErrLengthLimit. Zero means DefaultMaxSliceLen.
+	MaxSliceLen int64
+}
 
-		slice = reflect.Append(slice, reflect.ValueOf(elem))
+// Decode items with given settings.
+func (d Decoding) Decode(buf *bytes.Buffer, items ...any) error {
+	for _, item := range items {
+		err := d.decode(buf, item, "")
+		if err != nil {
+			return err
+		}
 	}
 
-	val.Elem().Set(slice)
+	return nil
 }
 
-// Check if struct implements Encoder interface.
-func isEncoder(v reflect.Value) bool {
-	_, ok := v.Interface().(Encoder)
-	return ok
+// Decode single value with bitbox tag options and given settings.
+func (d Decoding) DecodeField(buf *bytes.Buffer, item any, tag string) error {
+	return d.decode(buf, item, tag)
 }
 
-// Check if value is big.Int.
-func isBigInt(v reflect.Type) bool {
-	return v.PkgPath() == "math/big" && v.Name() == "Int"
+// Create stream decoder reading from r with given settings.
+func (d Decoding) NewDecoder(r io.Reader) *StreamDecoder {
+	return &StreamDecoder{r: r, decoding: d}
 }
 
-// Check if value is pointer.
-func isPointer(v reflect.Value) bool {
-	return v.Kind() == reflect.Pointer
-}
+func (d Decoding) decode(buf *bytes.Buffer, item any, tag string) error {
+	m, limit := d.Mode, d.MaxSliceLen
+	if limit == 0 {
+		limit = DefaultMaxSliceLen
+	}
 
-// Check if value is struct.
-func isStruct(v reflect.Value) bool {
-	return v.Kind() == reflect.Struct
-}
+	val := reflect.ValueOf(item)
 
-// Check if value is slice.
-func isSlice(v reflect.Value) bool {
-	return v.Kind() == reflect.Slice
-}
+	if val.Kind() != reflect.Pointer || val.IsNil() {
+		return prefixErr(decodeErr(ErrUnsupportedType, "not a pointer"), fmt.Sprintf("%T", item))
+	}
 
-// Check if value is array.
-func isArray(v reflect.Type) bool {
-	return v.Kind() == reflect.Array
-}
+	typ := val.Type().Elem()
+
+	c := codecOf(typ, m, limit)
+	if tag != "" {
+		c = taggedCodecOf(typ, m, limit, tag)
+	}
 
-// Check if element is pointer to slice.
-func isSlicePtr(elem any) bool {
-	t := reflect.TypeOf(elem)
-	return t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Slice
+	err := c.decode(buf, val.Elem())
+	if err != nil {
+		return prefixErr(err, typeName(val.Type()))
+	}
+
+	return nil
 }
@@ -0,0 +1,940 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+	"unsafe"
+)
+
+// Compiled encoder and decoder for a single type.
+//
+// Codecs are built once per type on first use and cached, so Encode
+// and Decode don't have to inspect types on every call.
+type codec struct {
+	encode func(buf *bytes.Buffer, val reflect.Value) error
+
+	// Decode into addressable value.
+	decode func(buf *bytes.Buffer, val reflect.Value) error
+
+	// Minimal number of bytes encoded value takes.
+	min int
+
+	// False for types which can't be decoded at all (chan, func, ...).
+	supported bool
+}
+
+var (
+	codecs  sync.Map // codecKey -> *codec
+	codecMu sync.Mutex
+
+	encoderType   = reflect.TypeFor[Encoder]()
+	decoderType   = reflect.TypeFor[Decoder]()
+	generatedType = reflect.TypeFor[generated]()
+	bigIntType    = reflect.TypeFor[big.Int]()
+	bigIntPtrType = reflect.TypeFor[*big.Int]()
+)
+
+type codecKey struct {
+	t    reflect.Type
+	mode Mode
+
+	// Decoding limit, see Decoding.MaxSliceLen.
+	limit int64
+
+	// Bitbox tag, only for codecs used by EncodeField/DecodeField.
+	tag string
+}
+
+// Codecs compiled together, they are published when all of them are
+// complete.
+type builder struct {
+	mode   Mode
+	limit  int64
+	codecs map[reflect.Type]*codec
+}
+
+// Get cached codec for given type, compile it if needed.
+func codecOf(t reflect.Type, mode Mode, limit int64) *codec {
+	if c, ok := codecs.Load(codecKey{t, mode, limit, ""}); ok {
+		return c.(*codec)
+	}
+
+	codecMu.Lock()
+	defer codecMu.Unlock()
+
+	b := &builder{mode: mode, limit: limit, codecs: map[reflect.Type]*codec{}}
+	c := compile(t, b)
+	b.publish()
+
+	return c
+}
+
+// Get cached codec for given type and bitbox tag.
+func taggedCodecOf(t reflect.Type, mode Mode, limit int64, tag string) *codec {
+	key := codecKey{t, mode, limit, tag}
+
+	if c, ok := codecs.Load(key); ok {
+		return c.(*codec)
+	}
+
+	codecMu.Lock()
+	defer codecMu.Unlock()
+
+	opts, err := parseTag(tag)
+	if err != nil || opts.skip {
+		if err == nil {
+			err = fmt.Errorf("%w: %q", ErrInvalidTag, tag)
+		}
+
+		c := &codec{}
+		compileInvalid(c, err)
+		return c
+	}
+
+	b := &builder{mode: mode, limit: limit, codecs: map[reflect.Type]*codec{}}
+	c := compileTagged(t, opts, b)
+	b.publish()
+
+	codecs.Store(key, c)
+	return c
+}
+
+func (b *builder) publish() {
+	for t, c := range b.codecs {
+		codecs.Store(codecKey{t, b.mode, b.limit, ""}, c)
+	}
+}
+
+func compile(t reflect.Type, b *builder) *codec {
+	if c, ok := codecs.Load(codecKey{t, b.mode, b.limit, ""}); ok {
+		return c.(*codec)
+	}
+
+	// Recursive types point to codec which is still being built. It's
+	// fine since codecs are only called when all of them are ready.
+	if c, ok := b.codecs[t]; ok {
+		return c
+	}
+
+	c := &codec{supported: isSupported(t)}
+	b.codecs[t] = c
+
+	switch t.Kind() {
+	case reflect.Bool:
+		compileBool(c)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		compileInt(c, int(t.Size()), b.mode)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		compileUint(c, int(t.Size()), b.mode)
+
+	case reflect.Float32:
+		compileFloat32(c, b.mode)
+
+	case reflect.Float64:
+		compileFloat64(c, b.mode)
+
+	case reflect.String:
+		compileString(c, b)
+
+	case reflect.Pointer:
+		if b.mode&View != 0 && t.Elem().Kind() == reflect.Array && t.Elem().Elem().Kind() == reflect.Uint8 && t.Elem().Len() > 0 {
+			compileArrayView(c, t)
+			break
+		}
+		compilePointer(c, t, b)
+
+	case reflect.Slice:
+		compileSlice(c, t, b)
+
+	case reflect.Array:
+		compileArray(c, t, b)
+
+	case reflect.Map:
+		compileMap(c, t, b)
+
+	case reflect.Struct:
+		// Also types defined as big.Int, ex: hexutil.Big.
+		if t.ConvertibleTo(bigIntType) {
+			compileBigInt(c, t, b)
+			break
+		}
+		compileStruct(c, t, b)
+
+	default:
+		compileUnsupported(c, t)
+	}
+
+	// Custom encoders and decoders have priority over everything else.
+	compileCustom(c, t, b)
+
+	return c
+}
+
+func compileUnsupported(c *codec, t reflect.Type) {
+	c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+		return encodeErr(ErrUnsupportedType, t)
+	}
+
+	c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+		return decodeErr(ErrUnsupportedType, t)
+	}
+}
+
+func compileCustom(c *codec, t reflect.Type, b *builder) {
+	m := b.mode
+	ptr := reflect.PointerTo(t)
+
+	// Pointers to generated types use their elem codec, so nil ones are
+	// handled as usual.
+	if t.Kind() != reflect.Pointer && ptr.Implements(generatedType) {
+		// Generated code writes DefaultMode layout only, other modes keep
+		// struct codec. Its Encode/Decode are wrappers, not an Encoder.
+		if m&modeMask != DefaultMode {
+			return
+		}
+
+		c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+			val = addressable(val)
+
+			err := val.Addr().Interface().(generated).EncodeTo(buf)
+			if err != nil {
+				return encodeErr(err, nil)
+			}
+			return nil
+		}
+
+		c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+			err := val.Addr().Interface().(generated).DecodeFrom(buf)
+			if err != nil {
+				return decodeErr(err, nil)
+			}
+			return nil
+		}
+		return
+	}
+
+	if t.Implements(encoderType) {
+		encode := c.encode
+		nilable := t.Kind() == reflect.Pointer || t.Kind() == reflect.Interface
+
+		c.min = m.lenSize()
+		c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+			// Nil pointers are still encoded as zero values.
+			if nilable && val.IsNil() {
+				return encode(buf, val)
+			}
+
+			m.putBytes(buf, val.Interface().(Encoder).Encode())
+			return nil
+		}
+	} else if ptr.Implements(encoderType) {
+		c.min = m.lenSize()
+		c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+			val = addressable(val)
+			m.putBytes(buf, val.Addr().Interface().(Encoder).Encode())
+			return nil
+		}
+	}
+
+	if ptr.Implements(decoderType) {
+		c.min = m.lenSize()
+		c.supported = true
+		c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+			raw, err := m.getBytes(buf, b.limit)
+			if err != nil {
+				return err
+			}
+
+			err = val.Addr().Interface().(Decoder).Decode(raw)
+			if err != nil {
+				return decodeErr(err, nil)
+			}
+			return nil
+		}
+	}
+}
+
+func compileBool(c *codec) {
+	c.min = 1
+
+	c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+		b := uint8(0)
+		if val.Bool() {
+			b = 1
+		}
+		return buf.WriteByte(b)
+	}
+
+	c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+		b, err := buf.ReadByte()
+		if err != nil {
+			return decodeErr(ErrShortBuffer, nil)
+		}
+		val.SetBool(b != 0)
+		return nil
+	}
+}
+
+func compileInt(c *codec, size int, m Mode) {
+	c.min = size
+	shift := 64 - 8*size
+
+	c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+		m.putUint(buf, uint64(val.Int()), size)
+		return nil
+	}
+
+	c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+		n, err := m.getUint(buf, size)
+		if err != nil {
+			return err
+		}
+
+		// Extend sign of smaller ints.
+		val.SetInt(int64(n<<shift) >> shift)
+		return nil
+	}
+}
+
+func compileUint(c *codec, size int, m Mode) {
+	c.min = size
+
+	c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+		m.putUint(buf, val.Uint(), size)
+		return nil
+	}
+
+	c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+		n, err := m.getUint(buf, size)
+		if err != nil {
+			return err
+		}
+		val.SetUint(n)
+		return nil
+	}
+}
+
+func compileFloat32(c *codec, m Mode) {
+	c.min = 4
+
+	c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+		m.putUint(buf, uint64(math.Float32bits(float32(val.Float()))), 4)
+		return nil
+	}
+
+	c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+		n, err := m.getUint(buf, 4)
+		if err != nil {
+			return err
+		}
+		val.SetFloat(float64(math.Float32frombits(uint32(n))))
+		return nil
+	}
+}
+
+func compileFloat64(c *codec, m Mode) {
+	c.min = 8
+
+	c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+		m.putUint(buf, math.Float64bits(val.Float()), 8)
+		return nil
+	}
+
+	c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+		n, err := m.getUint(buf, 8)
+		if err != nil {
+			return err
+		}
+		val.SetFloat(math.Float64frombits(n))
+		return nil
+	}
+}
+
+func compileString(c *codec, b *builder) {
+	m := b.mode
+	c.min = m.lenSize()
+
+	c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+		m.putLen(buf, val.Len())
+		buf.WriteString(val.String())
+		return nil
+	}
+
+	c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+		size, err := m.decodeLen(buf, 1, b.limit)
+		if err != nil {
+			return err
+		}
+		val.SetString(string(buf.Next(size)))
+		return nil
+	}
+}
+
+func compileBigInt(c *codec, t reflect.Type, b *builder) {
+	m := b.mode
+	c.min = m.lenSize()
+
+	// Pointer to value as *big.Int.
+	bigInt := func(val reflect.Value) *big.Int {
+		ptr := val.Addr()
+		if t != bigIntType {
+			ptr = ptr.Convert(bigIntPtrType)
+		}
+		return ptr.Interface().(*big.Int)
+	}
+
+	c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+		m.putBytes(buf, bigInt(addressable(val)).Bytes())
+		return nil
+	}
+
+	c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+		size, err := m.decodeLen(buf, 1, b.limit)
+		if err != nil {
+			return err
+		}
+		bigInt(val).SetBytes(buf.Next(size))
+		return nil
+	}
+}
+
+func compilePointer(c *codec, t reflect.Type, b *builder) {
+	elem := compile(t.Elem(), b)
+
+	// Nil pointers are encoded as zero values.
+	zero := reflect.New(t.Elem()).Elem()
+	c.min = elem.min
+
+	c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+		if val.IsNil() {
+			return elem.encode(buf, zero)
+		}
+		return elem.encode(buf, val.Elem())
+	}
+
+	c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+		if val.IsNil() {
+			val.Set(reflect.New(t.Elem()))
+		}
+		return elem.decode(buf, val.Elem())
+	}
+}
+
+// Pointers to byte arrays in View mode point directly into buffer.
+func compileArrayView(c *codec, t reflect.Type) {
+	size := t.Elem().Len()
+	c.min = size
+
+	c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+		if val.IsNil() {
+			buf.Write(make([]byte, size))
+			return nil
+		}
+		buf.Write(val.Elem().Bytes())
+		return nil
+	}
+
+	c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+		raw := buf.Next(size)
+		if len(raw) < size {
+			return decodeErr(ErrShortBuffer, nil)
+		}
+		val.Set(reflect.NewAt(t.Elem(), unsafe.Pointer(&raw[0])))
+		return nil
+	}
+}
+
+func compileSlice(c *codec, t reflect.Type, b *builder) {
+	// Fast path for []byte.
+	if t.Elem().Kind() == reflect.Uint8 {
+		compileBytes(c, b)
+		return
+	}
+
+	compileSliceOf(c, t, compile(t.Elem(), b), b)
+}
+
+func compileBytes(c *codec, b *builder) {
+	m := b.mode
+	c.min = m.lenSize()
+
+	c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+		m.putSliceLen(buf, val)
+		buf.Write(val.Bytes())
+		return nil
+	}
+
+	c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+		size, err := m.decodeSliceLen(buf, 1, b.limit)
+		if err != nil {
+			return err
+		}
+
+		switch size {
+		case emptyLen:
+			val.SetBytes([]byte{})
+			return nil
+		case 0:
+			val.SetZero()
+			return nil
+		}
+
+		val.SetBytes(m.bytes(buf, size))
+		return nil
+	}
+}
+
+func compileSliceOf(c *codec, t reflect.Type, elem *codec, b *builder) {
+	m := b.mode
+	c.min = m.lenSize()
+
+	c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+		m.putSliceLen(buf, val)
+		return encodeElems(buf, val, elem)
+	}
+
+	c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+		// Check element type first, before we allocate anything.
+		if !elem.supported {
+			return decodeErr(ErrUnsupportedType, t.Elem())
+		}
+
+		size, err := m.decodeSliceLen(buf, elem.min, b.limit)
+		if err != nil {
+			return err
+		}
+
+		switch size {
+		case emptyLen:
+			val.Set(reflect.MakeSlice(t, 0, 0))
+			return nil
+		case 0:
+			val.SetZero()
+			return nil
+		}
+
+		val.Set(reflect.MakeSlice(t, size, size))
+		return decodeElems(buf, val, elem)
+	}
+}
+
+func compileArray(c *codec, t reflect.Type, b *builder) {
+	// Fast path for byte arrays, ex: common.Hash, common.Address.
+	if t.Elem().Kind() == reflect.Uint8 {
+		compileByteArray(c, t.Len())
+		return
+	}
+
+	compileArrayOf(c, t, compile(t.Elem(), b))
+}
+
+func compileByteArray(c *codec, size int) {
+	c.min = size
+
+	c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+		val = addressable(val)
+		buf.Write(val.Bytes())
+		return nil
+	}
+
+	c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+		raw := buf.Next(size)
+		if len(raw) < size {
+			return decodeErr(ErrShortBuffer, nil)
+		}
+		copy(val.Bytes(), raw)
+		return nil
+	}
+}
+
+func compileArrayOf(c *codec, t reflect.Type, elem *codec) {
+	c.min = t.Len() * elem.min
+
+	c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+		return encodeElems(buf, val, elem)
+	}
+
+	c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+		return decodeElems(buf, val, elem)
+	}
+}
+
+func encodeElems(buf *bytes.Buffer, val reflect.Value, elem *codec) error {
+	for i := 0; i < val.Len(); i++ {
+		err := elem.encode(buf, val.Index(i))
+		if err != nil {
+			return prefixErr(err, "["+strconv.Itoa(i)+"]")
+		}
+	}
+
+	return nil
+}
+
+func decodeElems(buf *bytes.Buffer, val reflect.Value, elem *codec) error {
+	for i := 0; i < val.Len(); i++ {
+		err := elem.decode(buf, val.Index(i))
+		if err != nil {
+			return prefixErr(err, "["+strconv.Itoa(i)+"]")
+		}
+	}
+
+	return nil
+}
+
+// Maps are encoded as pairs sorted by encoded key, so the same map
+// always gives the same bytes.
+func compileMap(c *codec, t reflect.Type, b *builder) {
+	m := b.mode
+	c.min = m.lenSize()
+
+	key := compile(t.Key(), b)
+	elem := compile(t.Elem(), b)
+
+	type entry struct {
+		start, key, end int
+	}
+
+	c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+		// Encode all pairs into temporary buffer and sort them.
+		tmp := new(bytes.Buffer)
+		entries := make([]entry, 0, val.Len())
+
+		k := reflect.New(t.Key()).Elem()
+		v := reflect.New(t.Elem()).Elem()
+
+		iter := val.MapRange()
+		for iter.Next() {
+			k.SetIterKey(iter)
+			v.SetIterValue(iter)
+
+			e := entry{start: tmp.Len()}
+
+			err := key.encode(tmp, k)
+			if err != nil {
+				return prefixErr(err, "[key]")
+			}
+			e.key = tmp.Len()
+
+			err = elem.encode(tmp, v)
+			if err != nil {
+				return prefixErr(err, fmt.Sprintf("[%v]", k))
+			}
+			e.end = tmp.Len()
+
+			entries = append(entries, e)
+		}
+
+		raw := tmp.Bytes()
+		slices.SortFunc(entries, func(x, y entry) int {
+			return bytes.Compare(raw[x.start:x.key], raw[y.start:y.key])
+		})
+
+		m.putSliceLen(buf, val)
+		for _, e := range entries {
+			buf.Write(raw[e.start:e.end])
+		}
+
+		return nil
+	}
+
+	c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+		if !key.supported || !elem.supported {
+			return decodeErr(ErrUnsupportedType, t)
+		}
+
+		size, err := m.decodeSliceLen(buf, key.min+elem.min, b.limit)
+		if err != nil {
+			return err
+		}
+
+		switch size {
+		case emptyLen:
+			val.Set(reflect.MakeMap(t))
+			return nil
+		case 0:
+			val.SetZero()
+			return nil
+		}
+
+		m := reflect.MakeMapWithSize(t, size)
+
+		for i := 0; i < size; i++ {
+			k := reflect.New(t.Key()).Elem()
+			v := reflect.New(t.Elem()).Elem()
+
+			err := key.decode(buf, k)
+			if err != nil {
+				return prefixErr(err, "[key]")
+			}
+
+			err = elem.decode(buf, v)
+			if err != nil {
+				return prefixErr(err, fmt.Sprintf("[%v]", k))
+			}
+
+			m.SetMapIndex(k, v)
+		}
+
+		val.Set(m)
+		return nil
+	}
+}
+
+// Exported struct field with its compiled codec.
+type structField struct {
+	index int
+	name  string
+	id    int
+	codec *codec
+}
+
+// Structs are encoded field by field, unexported fields and fields
+// tagged with bitbox:"-" are skipped.
+func compileStruct(c *codec, t reflect.Type, b *builder) {
+	fields := []structField{}
+	withIDs := false
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		opts, err := parseTag(f.Tag.Get("bitbox"))
+		if opts.skip {
+			continue
+		}
+
+		fc := &codec{}
+		if err != nil {
+			compileInvalid(fc, err)
+		} else {
+			fc = compileTagged(f.Type, opts, b)
+		}
+
+		fields = append(fields, structField{i, "." + f.Name, opts.id, fc})
+		c.min += fc.min
+		withIDs = withIDs || opts.id != 0
+	}
+
+	if withIDs {
+		compileStructIDs(c, t, fields, b)
+		return
+	}
+
+	c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+		for _, f := range fields {
+			err := f.codec.encode(buf, val.Field(f.index))
+			if err != nil {
+				return prefixErr(err, f.name)
+			}
+		}
+		return nil
+	}
+
+	c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+		for _, f := range fields {
+			err := f.codec.decode(buf, val.Field(f.index))
+			if err != nil {
+				return prefixErr(err, f.name)
+			}
+		}
+		return nil
+	}
+}
+
+// Write number of given size without boxing it.
+func (m Mode) putUint(buf *bytes.Buffer, n uint64, size int) {
+	b := buf.AvailableBuffer()
+	order := m.order()
+
+	switch size {
+	case 1:
+		b = append(b, uint8(n))
+	case 2:
+		b = order.AppendUint16(b, uint16(n))
+	case 4:
+		b = order.AppendUint32(b, uint32(n))
+	default:
+		b = order.AppendUint64(b, n)
+	}
+
+	buf.Write(b)
+}
+
+func (m Mode) getUint(buf *bytes.Buffer, size int) (uint64, error) {
+	b := buf.Next(size)
+	if len(b) < size {
+		return 0, decodeErr(ErrShortBuffer, nil)
+	}
+
+	order := m.order()
+
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(order.Uint16(b)), nil
+	case 4:
+		return uint64(order.Uint32(b)), nil
+	}
+
+	return order.Uint64(b), nil
+}
+
+// Write length prefix.
+func (m Mode) putLen(buf *bytes.Buffer, n int) {
+	m.putRawLen(buf, uint64(n))
+}
+
+func (m Mode) putRawLen(buf *bytes.Buffer, n uint64) {
+	if m&Varint != 0 {
+		buf.Write(binary.AppendUvarint(buf.AvailableBuffer(), n))
+		return
+	}
+
+	m.putUint(buf, n, 8)
+}
+
+// Minimal size of length prefix.
+func (m Mode) lenSize() int {
+	if m&Varint != 0 {
+		return 1
+	}
+
+	return 8
+}
+
+// Write length prefixed bytes.
+func (m Mode) putBytes(buf *bytes.Buffer, data []byte) {
+	m.putLen(buf, len(data))
+	buf.Write(data)
+}
+
+// Read length prefixed bytes.
+func (m Mode) getBytes(buf *bytes.Buffer, limit int64) ([]byte, error) {
+	size, err := m.decodeLen(buf, 1, limit)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+
+	raw := make([]byte, size)
+	copy(raw, buf.Next(size))
+	return raw, nil
+}
+
+// Take next size bytes, copied unless in View mode. Caller must check
+// that buf has enough bytes.
+func (m Mode) bytes(buf *bytes.Buffer, size int) []byte {
+	raw := buf.Next(size)
+	if m&View != 0 {
+		return raw[:len(raw):len(raw)]
+	}
+
+	return bytes.Clone(raw)
+}
+
+// Decode length prefix of collection with elements taking at least min
+// bytes. Length is checked against limit and remaining bytes, so
+// corrupted buffer won't trigger huge allocations.
+func (m Mode) decodeLen(buf *bytes.Buffer, min int, limit int64) (int, error) {
+	n, err := m.readLen(buf)
+	if err != nil {
+		return 0, err
+	}
+
+	return m.checkLen(buf, n, min, limit)
+}
+
+// Decoded length of empty, non-nil slice or map.
+const emptyLen = -1
+
+// Like decodeLen, but returns emptyLen for empty, non-nil collections.
+func (m Mode) decodeSliceLen(buf *bytes.Buffer, min int, limit int64) (int, error) {
+	n, err := m.readLen(buf)
+	if err != nil {
+		return 0, err
+	}
+
+	if n == math.MaxUint64 {
+		return emptyLen, nil
+	}
+
+	return m.checkLen(buf, n, min, limit)
+}
+
+// Write length of slice or map, in KeepEmpty mode empty non-nil ones
+// get -1, so they can be told apart from nil ones.
+func (m Mode) putSliceLen(buf *bytes.Buffer, val reflect.Value) {
+	if m&KeepEmpty != 0 && val.Len() == 0 && !val.IsNil() {
+		m.putRawLen(buf, math.MaxUint64)
+		return
+	}
+
+	m.putLen(buf, val.Len())
+}
+
+func (m Mode) readLen(buf *bytes.Buffer) (uint64, error) {
+	if m&Varint != 0 {
+		n, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return 0, varintErr(err)
+		}
+		return n, nil
+	}
+
+	return m.getUint(buf, 8)
+}
+
+func (m Mode) checkLen(buf *bytes.Buffer, n uint64, min int, limit int64) (int, error) {
+	size := int64(n)
+
+	if size < 0 || size > limit {
+		return 0, decodeErr(ErrLengthLimit, size)
+	}
+
+	if size*int64(min) > int64(buf.Len()) {
+		return 0, decodeErr(ErrShortBuffer, size)
+	}
+
+	return int(size), nil
+}
+
+// Get addressable copy of the value if it isn't addressable already.
+func addressable(val reflect.Value) reflect.Value {
+	if val.CanAddr() {
+		return val
+	}
+
+	tmp := reflect.New(val.Type()).Elem()
+	tmp.Set(val)
+	return tmp
+}
+
+// Check if values of given type can be decoded at all.
+func isSupported(t reflect.Type) bool {
+	if reflect.PointerTo(t).Implements(decoderType) {
+		return true
+	}
+
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.UnsafePointer,
+		reflect.Complex64, reflect.Complex128, reflect.Uintptr:
+		return false
+	}
+
+	return true
+}
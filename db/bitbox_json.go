@@ -0,0 +1,226 @@
+package db
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+var (
+	jsonMarshalerType = reflect.TypeFor[json.Marshaler]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+)
+
+// Render bitbox encoded value of type t as JSON, for debugging stored
+// records. Raw must hold exactly one value.
+//
+// Structs keep fields in order of declaration, skipping ones that aren't
+// encoded. []byte and byte arrays are rendered as 0x prefixed hex, types
+// with their own JSON or text marshaling (ex: common.Address, hexutil.Big)
+// use it, nil slices, maps and pointers are rendered as null.
+func ToJSON(raw []byte, t reflect.Type) ([]byte, error) {
+	return DefaultMode.ToJSON(raw, t)
+}
+
+// Render value encoded in given mode as JSON, see ToJSON.
+func (m Mode) ToJSON(raw []byte, t reflect.Type) ([]byte, error) {
+	val := reflect.New(t)
+	buf := bytes.NewBuffer(raw)
+
+	err := m.Decode(buf, val.Interface())
+	if err != nil {
+		return nil, err
+	}
+
+	if buf.Len() > 0 {
+		return nil, prefixErr(decodeErr(ErrInvalidData, fmt.Sprintf("%d trailing bytes", buf.Len())), typeName(t))
+	}
+
+	out := new(bytes.Buffer)
+
+	err = writeJSON(out, val.Elem())
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+func writeJSON(out *bytes.Buffer, val reflect.Value) error {
+	t := val.Type()
+
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Map, reflect.Interface:
+		if val.IsNil() {
+			out.WriteString("null")
+			return nil
+		}
+	}
+
+	if marshals(t) {
+		raw, err := json.Marshal(addressable(val).Addr().Interface())
+		if err != nil {
+			return err
+		}
+
+		out.Write(raw)
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return writeJSON(out, val.Elem())
+
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			writeJSONString(out, hexString(val))
+			return nil
+		}
+
+		out.WriteByte('[')
+		for i := 0; i < val.Len(); i++ {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+
+			err := writeJSON(out, val.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		out.WriteByte(']')
+
+	case reflect.Map:
+		return writeJSONMap(out, val)
+
+	case reflect.Struct:
+		return writeJSONStruct(out, val)
+
+	default:
+		raw, err := json.Marshal(val.Interface())
+		if err != nil {
+			return err
+		}
+		out.Write(raw)
+	}
+
+	return nil
+}
+
+// Map entries sorted by their keys.
+func writeJSONMap(out *bytes.Buffer, val reflect.Value) error {
+	type entry struct {
+		key string
+		val reflect.Value
+	}
+
+	entries := make([]entry, 0, val.Len())
+
+	iter := val.MapRange()
+	for iter.Next() {
+		key, err := jsonKey(iter.Key())
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, entry{key, iter.Value()})
+	}
+
+	slices.SortFunc(entries, func(x, y entry) int {
+		return bytes.Compare([]byte(x.key), []byte(y.key))
+	})
+
+	out.WriteByte('{')
+	for i, e := range entries {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+
+		writeJSONString(out, e.key)
+		out.WriteByte(':')
+
+		err := writeJSON(out, e.val)
+		if err != nil {
+			return err
+		}
+	}
+	out.WriteByte('}')
+
+	return nil
+}
+
+// Struct fields which are encoded by bitbox.
+func writeJSONStruct(out *bytes.Buffer, val reflect.Value) error {
+	t := val.Type()
+
+	out.WriteByte('{')
+	first := true
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		opts, _ := parseTag(f.Tag.Get("bitbox"))
+		if opts.skip {
+			continue
+		}
+
+		if !first {
+			out.WriteByte(',')
+		}
+		first = false
+
+		writeJSONString(out, f.Name)
+		out.WriteByte(':')
+
+		err := writeJSON(out, val.Field(i))
+		if err != nil {
+			return err
+		}
+	}
+	out.WriteByte('}')
+
+	return nil
+}
+
+// Quoted JSON string, invalid UTF-8 is replaced like in json.Marshal.
+func writeJSONString(out *bytes.Buffer, s string) {
+	raw, _ := json.Marshal(s)
+	out.Write(raw)
+}
+
+// JSON object key for map key.
+func jsonKey(key reflect.Value) (string, error) {
+	t := key.Type()
+
+	switch {
+	case t.Implements(textMarshalerType):
+		raw, err := key.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(raw), err
+
+	case t.Kind() == reflect.String:
+		return key.String(), nil
+
+	case t.Kind() == reflect.Array && t.Elem().Kind() == reflect.Uint8:
+		return hexString(key), nil
+	}
+
+	return fmt.Sprint(key.Interface()), nil
+}
+
+// Check if type has its own JSON or text marshaling, on value or pointer.
+func marshals(t reflect.Type) bool {
+	ptr := reflect.PointerTo(t)
+
+	return ptr.Implements(jsonMarshalerType) || ptr.Implements(textMarshalerType)
+}
+
+func hexString(val reflect.Value) string {
+	return "0x" + hex.EncodeToString(addressable(val).Bytes())
+}
@@ -0,0 +1,420 @@
+package db
+
+import (
+	"bucketdb/tests"
+	"bytes"
+	"encoding/binary"
+	"math/big"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Reference implementation of bitbox walking values with reflection on
+// every call, as it was before codecs were compiled. It's kept only to
+// benchmark codecs against it and to check that both give the same
+// bytes in DefaultMode. Errors don't carry paths.
+
+func refEncode(elements ...any) (*bytes.Buffer, error) {
+	buf := new(bytes.Buffer)
+
+	for _, elem := range elements {
+		err := refEncodeValue(buf, reflect.ValueOf(elem))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buf, nil
+}
+
+func refEncodeValue(buf *bytes.Buffer, val reflect.Value) error {
+	if enc, ok := refEncoderOf(val); ok {
+		return refEncodeBytes(buf, enc.Encode())
+	}
+
+	typ := val.Type()
+
+	switch val.Kind() {
+	case reflect.Pointer:
+		if val.IsNil() {
+			return refEncodeValue(buf, reflect.Zero(typ.Elem()))
+		}
+		return refEncodeValue(buf, val.Elem())
+
+	case reflect.Bool:
+		b := uint8(0)
+		if val.Bool() {
+			b = 1
+		}
+		return buf.WriteByte(b)
+
+	case reflect.Int:
+		return refWrite(buf, val.Int())
+
+	case reflect.Uint:
+		return refWrite(buf, val.Uint())
+
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return refWrite(buf, val.Interface())
+
+	case reflect.String:
+		return refEncodeBytes(buf, []byte(val.String()))
+
+	case reflect.Slice:
+		refWrite(buf, int64(val.Len()))
+		return refEncodeElems(buf, val)
+
+	case reflect.Array:
+		return refEncodeElems(buf, val)
+
+	case reflect.Map:
+		return refEncodeMap(buf, val)
+
+	case reflect.Struct:
+		if typ == bigIntType {
+			bigint := val.Interface().(big.Int)
+			return refEncodeBytes(buf, bigint.Bytes())
+		}
+
+		for i := 0; i < typ.NumField(); i++ {
+			if !typ.Field(i).IsExported() {
+				continue
+			}
+
+			err := refEncodeValue(buf, val.Field(i))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return ErrUnsupportedType
+}
+
+func refEncodeBytes(buf *bytes.Buffer, data []byte) error {
+	refWrite(buf, int64(len(data)))
+	buf.Write(data)
+	return nil
+}
+
+func refEncodeElems(buf *bytes.Buffer, val reflect.Value) error {
+	elem := val.Type().Elem()
+
+	if val.Kind() == reflect.Slice && elem.Kind() == reflect.Uint8 {
+		buf.Write(val.Bytes())
+		return nil
+	}
+
+	if refIsFixed(elem) {
+		return refWrite(buf, val.Interface())
+	}
+
+	for i := 0; i < val.Len(); i++ {
+		err := refEncodeValue(buf, val.Index(i))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func refEncodeMap(buf *bytes.Buffer, val reflect.Value) error {
+	type entry struct {
+		key []byte
+		raw []byte
+	}
+
+	entries := make([]entry, 0, val.Len())
+	iter := val.MapRange()
+
+	for iter.Next() {
+		tmp := new(bytes.Buffer)
+
+		err := refEncodeValue(tmp, iter.Key())
+		if err != nil {
+			return err
+		}
+		size := tmp.Len()
+
+		err = refEncodeValue(tmp, iter.Value())
+		if err != nil {
+			return err
+		}
+
+		raw := tmp.Bytes()
+		entries = append(entries, entry{raw[:size], raw})
+	}
+
+	slices.SortFunc(entries, func(a, b entry) int {
+		return bytes.Compare(a.key, b.key)
+	})
+
+	refWrite(buf, int64(len(entries)))
+	for _, e := range entries {
+		buf.Write(e.raw)
+	}
+
+	return nil
+}
+
+func refEncoderOf(val reflect.Value) (Encoder, bool) {
+	typ := val.Type()
+
+	if typ.Implements(encoderType) {
+		kind := val.Kind()
+		if (kind == reflect.Pointer || kind == reflect.Interface) && val.IsNil() {
+			return nil, false
+		}
+		return val.Interface().(Encoder), true
+	}
+
+	if reflect.PointerTo(typ).Implements(encoderType) {
+		return addressable(val).Addr().Interface().(Encoder), true
+	}
+
+	return nil, false
+}
+
+func refWrite(buf *bytes.Buffer, elem any) error {
+	return binary.Write(buf, binary.BigEndian, elem)
+}
+
+func refDecode(buf *bytes.Buffer, items ...any) error {
+	for _, item := range items {
+		val := reflect.ValueOf(item)
+		if val.Kind() != reflect.Pointer || val.IsNil() {
+			return ErrUnsupportedType
+		}
+
+		err := refDecodeValue(buf, val.Elem())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func refDecodeValue(buf *bytes.Buffer, val reflect.Value) error {
+	if val.CanAddr() && reflect.PointerTo(val.Type()).Implements(decoderType) {
+		raw, err := refDecodeBytes(buf)
+		if err != nil {
+			return err
+		}
+		return val.Addr().Interface().(Decoder).Decode(raw)
+	}
+
+	typ := val.Type()
+
+	switch val.Kind() {
+	case reflect.Pointer:
+		if val.IsNil() {
+			val.Set(reflect.New(typ.Elem()))
+		}
+		return refDecodeValue(buf, val.Elem())
+
+	case reflect.Bool:
+		b, err := buf.ReadByte()
+		if err != nil {
+			return ErrShortBuffer
+		}
+		val.SetBool(b != 0)
+		return nil
+
+	case reflect.Int:
+		n := int64(0)
+		err := refRead(buf, &n)
+		val.SetInt(n)
+		return err
+
+	case reflect.Uint:
+		n := uint64(0)
+		err := refRead(buf, &n)
+		val.SetUint(n)
+		return err
+
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return refRead(buf, val.Addr().Interface())
+
+	case reflect.String:
+		raw, err := refDecodeBytes(buf)
+		if err != nil {
+			return err
+		}
+		val.SetString(string(raw))
+		return nil
+
+	case reflect.Slice:
+		size, err := refDecodeLen(buf)
+		if err != nil {
+			return err
+		}
+
+		if size == 0 {
+			val.Set(reflect.Zero(typ))
+			return nil
+		}
+
+		val.Set(reflect.MakeSlice(typ, int(size), int(size)))
+		return refDecodeElems(buf, val)
+
+	case reflect.Array:
+		return refDecodeElems(buf, val)
+
+	case reflect.Map:
+		size, err := refDecodeLen(buf)
+		if err != nil || size == 0 {
+			val.Set(reflect.Zero(typ))
+			return err
+		}
+
+		m := reflect.MakeMapWithSize(typ, int(size))
+
+		for i := int64(0); i < size; i++ {
+			key := reflect.New(typ.Key()).Elem()
+			elem := reflect.New(typ.Elem()).Elem()
+
+			err := refDecodeValue(buf, key)
+			if err != nil {
+				return err
+			}
+
+			err = refDecodeValue(buf, elem)
+			if err != nil {
+				return err
+			}
+
+			m.SetMapIndex(key, elem)
+		}
+
+		val.Set(m)
+		return nil
+
+	case reflect.Struct:
+		if typ == bigIntType {
+			raw, err := refDecodeBytes(buf)
+			if err != nil {
+				return err
+			}
+			val.Addr().Interface().(*big.Int).SetBytes(raw)
+			return nil
+		}
+
+		for i := 0; i < typ.NumField(); i++ {
+			if !typ.Field(i).IsExported() {
+				continue
+			}
+
+			err := refDecodeValue(buf, val.Field(i))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return ErrUnsupportedType
+}
+
+func refDecodeBytes(buf *bytes.Buffer) ([]byte, error) {
+	size, err := refDecodeLen(buf)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+
+	raw := make([]byte, size)
+	buf.Read(raw)
+	return raw, nil
+}
+
+func refDecodeElems(buf *bytes.Buffer, val reflect.Value) error {
+	elem := val.Type().Elem()
+
+	if val.Kind() == reflect.Slice && elem.Kind() == reflect.Uint8 {
+		if buf.Len() < val.Len() {
+			return ErrShortBuffer
+		}
+		buf.Read(val.Bytes())
+		return nil
+	}
+
+	if refIsFixed(elem) {
+		return refRead(buf, val.Addr().Interface())
+	}
+
+	for i := 0; i < val.Len(); i++ {
+		err := refDecodeValue(buf, val.Index(i))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func refDecodeLen(buf *bytes.Buffer) (int64, error) {
+	size := int64(0)
+
+	err := refRead(buf, &size)
+	if err != nil {
+		return 0, err
+	}
+
+	if size < 0 || size > DefaultMaxSliceLen || size > int64(buf.Len()) {
+		return 0, ErrLengthLimit
+	}
+
+	return size, nil
+}
+
+func refRead(buf *bytes.Buffer, dst any) error {
+	err := binary.Read(buf, binary.BigEndian, dst)
+	if err != nil {
+		return ErrShortBuffer
+	}
+
+	return nil
+}
+
+func refIsFixed(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool,
+		reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+
+	return false
+}
+
+func benchShape() Shape {
+	return Shape{Name: "triangle", Points: []Point{{0, 0}, {2, 0}, {1, 2}}, Tags: map[string]uint64{"sides": 3}}
+}
+
+func TestReferenceCodec(t *testing.T) {
+	for _, elem := range []any{benchTx(), benchShape(), make([]byte, 32)} {
+		raw, _ := Encode(elem)
+		ref, err := refEncode(elem)
+
+		tests.Assert(t, nil, err)
+		tests.AssertEqual(t, raw.Bytes(), ref.Bytes())
+	}
+
+	raw, _ := Encode(benchTx())
+	tx, ref := TestTx{}, TestTx{}
+
+	Decode(bytes.NewBuffer(raw.Bytes()), &tx)
+	tests.Assert(t, nil, refDecode(raw, &ref))
+	tests.AssertEqual(t, tx, ref)
+	tests.Assert(t, common.Address{1, 2, 3}, *ref.To)
+}
@@ -0,0 +1,186 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// Don't keep huge scratch buffers around after encoding large values.
+const maxStreamBuffer = 1 << 20
+
+// Minimal number of bytes requested from reader at once.
+const minStreamRead = 512
+
+// Encoder writing bitbox values to io.Writer. Output is the same as
+// concatenated Encode results, so it can be read with Decode as well.
+type StreamEncoder struct {
+	w    io.Writer
+	mode Mode
+	buf  bytes.Buffer
+}
+
+// Decoder reading bitbox values from io.Reader. It reads only as much
+// as needed to decode next value, the rest is kept for next calls.
+type StreamDecoder struct {
+	r        io.Reader
+	decoding Decoding
+	buf      []byte
+	err      error
+}
+
+// Create encoder writing to w in DefaultMode.
+func NewEncoder(w io.Writer) *StreamEncoder {
+	return DefaultMode.NewEncoder(w)
+}
+
+// Create decoder reading from r in DefaultMode.
+func NewDecoder(r io.Reader) *StreamDecoder {
+	return DefaultMode.NewDecoder(r)
+}
+
+// Create encoder writing to w in given mode.
+func (m Mode) NewEncoder(w io.Writer) *StreamEncoder {
+	return &StreamEncoder{w: w, mode: m}
+}
+
+// Create decoder reading from r in given mode.
+func (m Mode) NewDecoder(r io.Reader) *StreamDecoder {
+	return Decoding{Mode: m}.NewDecoder(r)
+}
+
+// Encode elements and write them to the underlying writer.
+// Nothing is written if any element fails to encode.
+func (e *StreamEncoder) Encode(elements ...any) error {
+	return e.write(func() error { return e.mode.EncodeTo(&e.buf, elements...) })
+}
+
+// Write mode header, so the stream can be read by decoder which doesn't
+// know its mode, see ReadHeader.
+func (e *StreamEncoder) WriteHeader() error {
+	return e.write(func() error {
+		e.mode.EncodeHeader(&e.buf)
+		return nil
+	})
+}
+
+// Encode single value with bitbox tag options.
+func (e *StreamEncoder) EncodeField(elem any, tag string) error {
+	return e.write(func() error { return e.mode.EncodeField(&e.buf, elem, tag) })
+}
+
+func (e *StreamEncoder) write(encode func() error) error {
+	e.buf.Reset()
+	defer func() {
+		if e.buf.Cap() > maxStreamBuffer {
+			e.buf = bytes.Buffer{}
+		}
+	}()
+
+	err := encode()
+	if err != nil {
+		return err
+	}
+
+	_, err = e.w.Write(e.buf.Bytes())
+	return err
+}
+
+// Decode items one after another, each item must be a pointer.
+// Returns io.EOF if stream ended before the first item.
+func (d *StreamDecoder) Decode(items ...any) error {
+	for _, item := range items {
+		err := d.decode(item, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Read mode header written by WriteHeader and decode the rest of the
+// stream in that mode. View flag of the decoder is kept.
+func (d *StreamDecoder) ReadHeader() error {
+	// Single byte, it's the same in all modes.
+	var header uint8
+
+	err := d.decode(&header, "")
+	if err != nil {
+		return err
+	}
+
+	mode, err := parseMode(header)
+	if err != nil {
+		return err
+	}
+
+	d.decoding.Mode = mode | d.decoding.Mode&View
+	return nil
+}
+
+// Decode single value encoded with EncodeField using the same tag.
+func (d *StreamDecoder) DecodeField(item any, tag string) error {
+	return d.decode(item, tag)
+}
+
+// Data read from reader but not decoded yet.
+func (d *StreamDecoder) Buffered() io.Reader {
+	return bytes.NewReader(d.buf)
+}
+
+// Decode item from buffered data, reading more until it's complete.
+// Each retry reads at least as much as is buffered, so large values
+// are decoded only a few times.
+func (d *StreamDecoder) decode(item any, tag string) error {
+	for {
+		buf := bytes.NewBuffer(d.buf)
+
+		err := d.decoding.decode(buf, item, tag)
+		if err == nil {
+			d.buf = d.buf[len(d.buf)-buf.Len():]
+			return nil
+		}
+
+		if !errors.Is(err, ErrShortBuffer) {
+			return err
+		}
+
+		if d.err != nil {
+			if d.err == io.EOF && len(d.buf) == 0 {
+				return io.EOF
+			}
+
+			if d.err == io.EOF {
+				return err
+			}
+			return d.err
+		}
+
+		d.fill()
+	}
+}
+
+// Read next chunk from reader, at least doubling buffered data.
+func (d *StreamDecoder) fill() {
+	size := max(len(d.buf), minStreamRead)
+
+	if cap(d.buf)-len(d.buf) < size {
+		buf := make([]byte, len(d.buf), len(d.buf)+size)
+		copy(buf, d.buf)
+		d.buf = buf
+	}
+
+	// Like bufio, give up on readers returning nothing over and over.
+	for i := 0; i < 100; i++ {
+		n, err := d.r.Read(d.buf[len(d.buf):cap(d.buf)])
+		d.buf = d.buf[:len(d.buf)+n]
+		d.err = err
+
+		if n > 0 || err != nil {
+			return
+		}
+	}
+
+	d.err = io.ErrNoProgress
+}
@@ -0,0 +1,378 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Options from bitbox struct tag, ex: `bitbox:"optional,varint"`.
+//
+//	"-"        field is skipped
+//	optional   presence byte, zero values (ex: nil pointers) are not encoded
+//	varint     integers (or slice/array elements) as varints
+//	fixed=N    slice or string of exactly N elements, without length prefix
+//	id=N       field ID, see compileStructIDs
+type tagOptions struct {
+	skip     bool
+	optional bool
+	varint   bool
+	fixed    int
+	id       int
+}
+
+func parseTag(tag string) (tagOptions, error) {
+	opts := tagOptions{}
+
+	if tag == "" {
+		return opts, nil
+	}
+
+	for _, opt := range strings.Split(tag, ",") {
+		switch {
+		case opt == "-":
+			opts.skip = true
+		case opt == "optional":
+			opts.optional = true
+		case opt == "varint":
+			opts.varint = true
+		case strings.HasPrefix(opt, "fixed="):
+			n, err := strconv.Atoi(opt[len("fixed="):])
+			if err != nil || n <= 0 {
+				return opts, fmt.Errorf("%w: %q", ErrInvalidTag, opt)
+			}
+			opts.fixed = n
+		case strings.HasPrefix(opt, "id="):
+			n, err := strconv.Atoi(opt[len("id="):])
+			if err != nil || n <= 0 {
+				return opts, fmt.Errorf("%w: %q", ErrInvalidTag, opt)
+			}
+			opts.id = n
+		default:
+			return opts, fmt.Errorf("%w: %q", ErrInvalidTag, opt)
+		}
+	}
+
+	return opts, nil
+}
+
+// Compile codec for value with tag options.
+func compileTagged(t reflect.Type, opts tagOptions, b *builder) *codec {
+	if !opts.optional && !opts.varint && opts.fixed == 0 {
+		return compile(t, b)
+	}
+
+	c := &codec{supported: isSupported(t)}
+	kind := t.Kind()
+
+	// Codec for slice/array elements, if tags change them.
+	var elem *codec
+
+	if opts.varint {
+		switch {
+		case isInteger(kind):
+			compileVarint(c, t)
+		case (kind == reflect.Slice || kind == reflect.Array) && isInteger(t.Elem().Kind()):
+			elem = &codec{supported: true}
+			compileVarint(elem, t.Elem())
+		default:
+			compileInvalid(c, fmt.Errorf("%w: varint on %s", ErrInvalidTag, t))
+			return c
+		}
+	}
+
+	switch {
+	case opts.fixed > 0:
+		if elem == nil && (kind == reflect.Slice || kind == reflect.Array) && t.Elem().Kind() != reflect.Uint8 {
+			elem = compile(t.Elem(), b)
+		}
+		compileFixed(c, t, opts.fixed, elem, b.mode)
+
+	case elem != nil && kind == reflect.Slice:
+		compileSliceOf(c, t, elem, b)
+
+	case elem != nil && kind == reflect.Array:
+		compileArrayOf(c, t, elem)
+
+	case !opts.varint:
+		c = compile(t, b)
+	}
+
+	if opts.optional {
+		inner := c
+		c = &codec{supported: inner.supported}
+		compileOptional(c, inner)
+	}
+
+	return c
+}
+
+// Codec which always fails, used for invalid tags.
+func compileInvalid(c *codec, err error) {
+	c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+		return encodeErr(err, nil)
+	}
+
+	c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+		return decodeErr(err, nil)
+	}
+}
+
+// Optional values are written after presence byte, zero values are
+// written as a single 0.
+func compileOptional(c *codec, inner *codec) {
+	c.min = 1
+
+	c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+		if val.IsZero() {
+			return buf.WriteByte(0)
+		}
+
+		buf.WriteByte(1)
+		return inner.encode(buf, val)
+	}
+
+	c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+		present, err := buf.ReadByte()
+		if err != nil {
+			return decodeErr(ErrShortBuffer, nil)
+		}
+
+		switch present {
+		case 0:
+			val.SetZero()
+			return nil
+		case 1:
+			return inner.decode(buf, val)
+		}
+
+		return decodeErr(ErrInvalidData, fmt.Sprintf("presence byte %d", present))
+	}
+}
+
+func compileVarint(c *codec, t reflect.Type) {
+	c.min = 1
+
+	if isSigned(t.Kind()) {
+		c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+			buf.Write(binary.AppendVarint(buf.AvailableBuffer(), val.Int()))
+			return nil
+		}
+
+		c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+			n, err := binary.ReadVarint(buf)
+			if err != nil {
+				return varintErr(err)
+			}
+
+			if val.OverflowInt(n) {
+				return decodeErr(ErrInvalidData, fmt.Sprintf("%d overflows %s", n, t))
+			}
+			val.SetInt(n)
+			return nil
+		}
+		return
+	}
+
+	c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+		buf.Write(binary.AppendUvarint(buf.AvailableBuffer(), val.Uint()))
+		return nil
+	}
+
+	c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+		n, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return varintErr(err)
+		}
+
+		if val.OverflowUint(n) {
+			return decodeErr(ErrInvalidData, fmt.Sprintf("%d overflows %s", n, t))
+		}
+		val.SetUint(n)
+		return nil
+	}
+}
+
+func varintErr(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return decodeErr(ErrShortBuffer, nil)
+	}
+
+	return decodeErr(ErrInvalidData, err)
+}
+
+// Slices and strings with fixed number of elements are written without
+// length prefix. Encoding fails if length doesn't match.
+func compileFixed(c *codec, t reflect.Type, size int, elem *codec, m Mode) {
+	kind := t.Kind()
+
+	checkLen := func(val reflect.Value) error {
+		if val.Len() != size {
+			return encodeErr(ErrFixedLength, fmt.Sprintf("%d != %d", val.Len(), size))
+		}
+		return nil
+	}
+
+	switch {
+	case kind == reflect.Array && t.Len() != size:
+		compileInvalid(c, fmt.Errorf("%w: fixed=%d on %s", ErrInvalidTag, size, t))
+
+	case kind == reflect.Array && elem == nil:
+		compileByteArray(c, size)
+
+	case kind == reflect.Array:
+		compileArrayOf(c, t, elem)
+
+	case kind == reflect.String || (kind == reflect.Slice && elem == nil):
+		c.min = size
+
+		c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+			if err := checkLen(val); err != nil {
+				return err
+			}
+
+			if kind == reflect.String {
+				buf.WriteString(val.String())
+			} else {
+				buf.Write(val.Bytes())
+			}
+			return nil
+		}
+
+		c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+			if buf.Len() < size {
+				return decodeErr(ErrShortBuffer, nil)
+			}
+
+			if kind == reflect.String {
+				val.SetString(string(buf.Next(size)))
+			} else {
+				val.SetBytes(m.bytes(buf, size))
+			}
+			return nil
+		}
+
+	case kind == reflect.Slice:
+		c.min = size * elem.min
+
+		c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+			if err := checkLen(val); err != nil {
+				return err
+			}
+			return encodeElems(buf, val, elem)
+		}
+
+		c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+			if size*elem.min > buf.Len() {
+				return decodeErr(ErrShortBuffer, size)
+			}
+
+			val.Set(reflect.MakeSlice(t, size, size))
+			return decodeElems(buf, val, elem)
+		}
+
+	default:
+		compileInvalid(c, fmt.Errorf("%w: fixed=%d on %s", ErrInvalidTag, size, t))
+	}
+}
+
+// Structs with field IDs, ex: `bitbox:"id=1"`, are written as:
+//
+//	field count | (uvarint id | length | field bytes)...
+//
+// Unknown IDs are skipped and fields missing from data are set to zero,
+// so fields can be added or removed without rewriting stored values.
+// IDs must be unique and either all encoded fields have one, or none.
+func compileStructIDs(c *codec, t reflect.Type, fields []structField, b *builder) {
+	m := b.mode
+	ids := map[uint64]int{}
+
+	for i, f := range fields {
+		if f.id == 0 {
+			compileInvalid(c, fmt.Errorf("%w: missing id on %s%s", ErrInvalidTag, t, f.name))
+			return
+		}
+
+		if _, ok := ids[uint64(f.id)]; ok {
+			compileInvalid(c, fmt.Errorf("%w: duplicate id=%d on %s%s", ErrInvalidTag, f.id, t, f.name))
+			return
+		}
+		ids[uint64(f.id)] = i
+	}
+
+	c.min = m.lenSize()
+
+	c.encode = func(buf *bytes.Buffer, val reflect.Value) error {
+		m.putLen(buf, len(fields))
+
+		// Field length must be known before the field is written.
+		tmp := new(bytes.Buffer)
+
+		for _, f := range fields {
+			tmp.Reset()
+
+			err := f.codec.encode(tmp, val.Field(f.index))
+			if err != nil {
+				return prefixErr(err, f.name)
+			}
+
+			buf.Write(binary.AppendUvarint(buf.AvailableBuffer(), uint64(f.id)))
+			m.putBytes(buf, tmp.Bytes())
+		}
+		return nil
+	}
+
+	c.decode = func(buf *bytes.Buffer, val reflect.Value) error {
+		// Each field takes at least id and length.
+		count, err := m.decodeLen(buf, 1+m.lenSize(), b.limit)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range fields {
+			val.Field(f.index).SetZero()
+		}
+
+		for range count {
+			id, err := binary.ReadUvarint(buf)
+			if err != nil {
+				return varintErr(err)
+			}
+
+			size, err := m.decodeLen(buf, 1, b.limit)
+			if err != nil {
+				return err
+			}
+
+			data := bytes.NewBuffer(buf.Next(size))
+
+			i, ok := ids[id]
+			if !ok {
+				continue
+			}
+			f := fields[i]
+
+			err = f.codec.decode(data, val.Field(f.index))
+			if err != nil {
+				return prefixErr(err, f.name)
+			}
+
+			if data.Len() > 0 {
+				return prefixErr(decodeErr(ErrInvalidData, fmt.Sprintf("%d trailing bytes", data.Len())), f.name)
+			}
+		}
+		return nil
+	}
+}
+
+func isInteger(kind reflect.Kind) bool {
+	return isSigned(kind) || (kind >= reflect.Uint && kind <= reflect.Uint64)
+}
+
+func isSigned(kind reflect.Kind) bool {
+	return kind >= reflect.Int && kind <= reflect.Int64
+}
@@ -3,10 +3,17 @@ package db
 import (
 	"bucketdb/tests"
 	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math/big"
+	"reflect"
+	"runtime"
 	"slices"
 	"testing"
+	"testing/iotest"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
@@ -145,9 +152,8 @@ func TestDecodeEncodeStruct(t *testing.T) {
 
 	raw, _ := Encode(v1)
 	Decode(raw, v2)
-	fmt.Println(v2)
 
-	if !bytes.Equal([]byte{0, 0, 0, 0, 0, 0, 0, 3, 6, 6, 6}, v2.Data) {
+	if !bytes.Equal(v1.Data, v2.Data) {
 		t.Errorf("Expected \n to get %v,\nbut got %v", v1.Data, v2.Data)
 	}
 }
@@ -173,7 +179,7 @@ func TestDecodeEncodeArrayOfStructs(t *testing.T) {
 }
 
 // For testing purpose only. Will be removed.
-type Tx struct {
+type TestTx struct {
 	Type        uint16
 	To          *common.Address
 	From        *common.Address
@@ -196,7 +202,7 @@ type Tx struct {
 }
 
 func TestEncodeStructFields(t *testing.T) {
-	tx1 := Tx{
+	tx1 := TestTx{
 		Hash:        common.Hash{1, 2, 3, 4},
 		Nonce:       uint64(444),
 		Ids:         []int32{22, 33, 44},
@@ -210,7 +216,7 @@ func TestEncodeStructFields(t *testing.T) {
 		GasTipCap:   big.NewInt(12345678910),
 	}
 
-	tx2 := Tx{}
+	tx2 := TestTx{}
 
 	buf, err := Encode(tx1)
 	if err != nil {
@@ -250,3 +256,936 @@ func TestDecode2Uint(t *testing.T) {
 	Decode2(ToBytes(&a), ToBytes(&c))
 	tests.Assert(t, a, c)
 }
+
+func TestDecodeErrors(t *testing.T) {
+	// Short buffer.
+	v := uint64(0)
+	err := Decode(bytes.NewBuffer([]byte{1, 2, 3}), &v)
+	tests.Assert(t, true, errors.Is(err, ErrShortBuffer))
+
+	// Slice length bigger than the buffer.
+	raw, _ := Encode([]uint64{1, 2, 3})
+	s := []uint64{}
+	err = Decode(bytes.NewBuffer(raw.Bytes()[:20]), &s)
+	tests.Assert(t, true, errors.Is(err, ErrShortBuffer))
+
+	// Slice length over limit.
+	err = Decoding{MaxSliceLen: 2}.Decode(bytes.NewBuffer(raw.Bytes()), &s)
+	tests.Assert(t, true, errors.Is(err, ErrLengthLimit))
+
+	// Default limit is used by other decoders.
+	err = Decode(bytes.NewBuffer(raw.Bytes()), &s)
+	tests.Assert(t, nil, err)
+
+	// Unsupported type.
+	c := []chan int{}
+	err = Decode(bytes.NewBuffer(raw.Bytes()), &c)
+	tests.Assert(t, true, errors.Is(err, ErrUnsupportedType))
+}
+
+func TestDecodeLengthAllocs(t *testing.T) {
+	// Length of 1<<24 pointers without elements.
+	raw := binary.BigEndian.AppendUint64(nil, 1<<24)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	ptrs := []*uint64{}
+	err := Decode(bytes.NewBuffer(raw), &ptrs)
+	tests.Assert(t, true, errors.Is(err, ErrShortBuffer))
+
+	// Slice isn't allocated before elements are checked.
+	runtime.ReadMemStats(&after)
+	tests.Assert(t, true, after.TotalAlloc-before.TotalAlloc < 1<<20)
+}
+
+func TestDecodeErrorPath(t *testing.T) {
+	raw, _ := Encode(TestTx{Ids: []int32{1, 2, 3}})
+
+	// Cut buffer in the middle of Ids.
+	tx := TestTx{}
+	err := Decode(bytes.NewBuffer(raw.Bytes()[:50]), &tx)
+
+	var derr *DecodeError
+	tests.Assert(t, true, errors.As(err, &derr))
+	tests.Assert(t, "db.TestTx.Ids", derr.Path)
+}
+
+// Helper for encoding/decoding any value and comparing result with reflect.DeepEqual.
+func RoundTrip[T any](t *testing.T, elem T) {
+	t.Helper()
+	RoundTripMode(t, DefaultMode, elem)
+}
+
+func RoundTripMode[T any](t *testing.T, mode Mode, elem T) {
+	t.Helper()
+
+	raw, err := mode.Encode(elem)
+	tests.Assert(t, nil, err)
+
+	var result T
+	err = mode.Decode(raw, &result)
+	tests.Assert(t, nil, err)
+	tests.Assert(t, 0, raw.Len())
+	tests.AssertEqual(t, elem, result)
+}
+
+type Point struct {
+	X, Y int32
+}
+
+type Shape struct {
+	Name   string
+	Closed bool
+	Center Point
+	Points []Point
+	Tags   map[string]uint64
+	Parent *Point
+	Count  int
+	Size   uint
+
+	hidden int
+}
+
+func TestEncodeDecodeString(t *testing.T) {
+	RoundTrip(t, "hello bitbox")
+	RoundTrip(t, []string{"a", "bc", "def"})
+
+	raw, _ := Encode("")
+	tests.Assert(t, 8, raw.Len())
+}
+
+func TestEncodeDecodeBool(t *testing.T) {
+	RoundTrip(t, true)
+	RoundTrip(t, false)
+	RoundTrip(t, []bool{true, false, true})
+	RoundTrip(t, [3]bool{false, true, true})
+}
+
+func TestEncodeDecodeInt(t *testing.T) {
+	RoundTrip(t, int(-12345))
+	RoundTrip(t, uint(12345))
+	RoundTrip(t, []int{1, -2, 3})
+}
+
+func TestEncodeDecodeMap(t *testing.T) {
+	RoundTrip(t, map[string]uint64{"a": 1, "b": 2, "c": 3})
+	RoundTrip(t, map[uint32][]byte{1: {1}, 2: {2, 2}})
+	RoundTrip(t, map[string]Point{"start": {1, 2}, "end": {3, 4}})
+
+	// Encoding must not depend on map iteration order.
+	m := map[int32]string{}
+	for i := int32(0); i < 100; i++ {
+		m[i] = fmt.Sprint(i)
+	}
+
+	first, _ := Encode(m)
+	for i := 0; i < 10; i++ {
+		raw, _ := Encode(m)
+		tests.Assert(t, true, bytes.Equal(first.Bytes(), raw.Bytes()))
+	}
+}
+
+func TestEncodeDecodeNestedStruct(t *testing.T) {
+	s := Shape{
+		Name:   "triangle",
+		Closed: true,
+		Center: Point{1, 1},
+		Points: []Point{{0, 0}, {2, 0}, {1, 2}},
+		Tags:   map[string]uint64{"sides": 3},
+		Parent: &Point{5, 5},
+		Count:  -3,
+		Size:   3,
+	}
+	RoundTrip(t, s)
+	RoundTrip(t, &s)
+	RoundTrip(t, []Shape{s, {Name: "empty", Parent: &Point{}}})
+}
+
+func TestEncodeDecodePointers(t *testing.T) {
+	v := uint64(7)
+	RoundTrip(t, &v)
+	RoundTrip(t, []*Point{{1, 2}, {3, 4}})
+
+	// Nil pointers are encoded as zero values.
+	raw, _ := Encode(Shape{})
+	s := Shape{}
+	err := Decode(raw, &s)
+
+	tests.Assert(t, nil, err)
+	tests.Assert(t, Point{}, *s.Parent)
+}
+
+func TestEncodeUnexportedFields(t *testing.T) {
+	raw, _ := Encode(Shape{hidden: 5})
+
+	s := Shape{}
+	Decode(raw, &s)
+	tests.Assert(t, 0, s.hidden)
+}
+
+func TestEncodeUnsupported(t *testing.T) {
+	_, err := Encode(make(chan int))
+	tests.Assert(t, true, errors.Is(err, ErrUnsupportedType))
+
+	var eerr *EncodeError
+	_, err = Encode(struct{ Fn func() }{})
+	tests.Assert(t, true, errors.As(err, &eerr))
+	tests.Assert(t, "struct { Fn func() }.Fn", eerr.Path)
+}
+
+type Tree struct {
+	Value uint32
+	Kids  []Tree
+}
+
+func TestCodecRecursive(t *testing.T) {
+	RoundTrip(t, Tree{1, []Tree{{2, nil}, {3, []Tree{{4, nil}}}}})
+}
+
+func TestCodecConcurrent(t *testing.T) {
+	type Pair struct {
+		Key string
+		Val []int16
+	}
+
+	tests.RunConcurrently(10, func() {
+		RoundTrip(t, Pair{"key", []int16{-1, 2, -3}})
+	})
+}
+
+type Tagged struct {
+	Id      uint64  `bitbox:"varint"`
+	Delta   int32   `bitbox:"varint"`
+	Parent  *Point  `bitbox:"optional"`
+	Hash    []byte  `bitbox:"fixed=4"`
+	Code    string  `bitbox:"fixed=2"`
+	Counts  []int64 `bitbox:"varint"`
+	Memo    string  `bitbox:"optional"`
+	Ignored string  `bitbox:"-"`
+}
+
+func TestTagsRoundTrip(t *testing.T) {
+	RoundTrip(t, Tagged{Id: 300, Delta: -5, Hash: []byte{1, 2, 3, 4}, Code: "pl", Counts: []int64{-1, 1000}})
+	RoundTrip(t, Tagged{Parent: &Point{1, 2}, Hash: []byte{1, 2, 3, 4}, Code: "en", Memo: "memo"})
+}
+
+func TestTagsLayout(t *testing.T) {
+	v := Tagged{Id: 300, Delta: -5, Hash: []byte{1, 2, 3, 4}, Code: "pl", Ignored: "skip me"}
+	raw, err := Encode(v)
+	tests.Assert(t, nil, err)
+
+	expected := []byte{
+		0xac, 0x02, // Id varint
+		0x09,       // Delta zigzag varint
+		0,          // Parent missing
+		1, 2, 3, 4, // Hash, no length prefix
+		'p', 'l', // Code, no length prefix
+		0, 0, 0, 0, 0, 0, 0, 0, // Counts length
+		0, // Memo missing
+	}
+	tests.AssertEqual(t, expected, raw.Bytes())
+
+	// Skipped fields are not decoded.
+	v2 := Tagged{}
+	Decode(raw, &v2)
+	tests.Assert(t, "", v2.Ignored)
+	tests.Assert(t, true, v2.Parent == nil)
+}
+
+func TestTagsErrors(t *testing.T) {
+	// Fixed length mismatch.
+	_, err := Encode(Tagged{Hash: []byte{1}, Code: "pl"})
+	tests.Assert(t, true, errors.Is(err, ErrFixedLength))
+
+	var eerr *EncodeError
+	tests.Assert(t, true, errors.As(err, &eerr))
+	tests.Assert(t, "db.Tagged.Hash", eerr.Path)
+
+	// Invalid tags.
+	_, err = Encode(struct {
+		Name string `bitbox:"varint"`
+	}{})
+	tests.Assert(t, true, errors.Is(err, ErrInvalidTag))
+
+	_, err = Encode(struct {
+		Name string `bitbox:"fixed=x"`
+	}{})
+	tests.Assert(t, true, errors.Is(err, ErrInvalidTag))
+
+	// Varint overflow.
+	type Small struct {
+		N uint8 `bitbox:"varint"`
+	}
+	raw, _ := Encode(struct {
+		N uint64 `bitbox:"varint"`
+	}{1000})
+	err = Decode(raw, &Small{})
+	tests.Assert(t, true, errors.Is(err, ErrInvalidData))
+
+	// Invalid presence byte.
+	type Opt struct {
+		P *Point `bitbox:"optional"`
+	}
+	err = Decode(bytes.NewBuffer([]byte{7}), &Opt{})
+	tests.Assert(t, true, errors.Is(err, ErrInvalidData))
+}
+
+func TestEncodeField(t *testing.T) {
+	buf := new(bytes.Buffer)
+	err := EncodeField(buf, uint64(300), "varint")
+	tests.Assert(t, nil, err)
+	tests.AssertEqual(t, []byte{0xac, 0x02}, buf.Bytes())
+
+	n := uint64(0)
+	err = DecodeField(buf, &n, "varint")
+	tests.Assert(t, nil, err)
+	tests.Assert(t, 300, n)
+}
+
+func TestModes(t *testing.T) {
+	s := Shape{
+		Name:   "triangle",
+		Points: []Point{{0, 0}, {2, 0}, {1, 2}},
+		Tags:   map[string]uint64{"sides": 3},
+		Parent: &Point{5, 5},
+		Count:  -3,
+	}
+
+	for _, mode := range []Mode{DefaultMode, Varint, LittleEndian, Varint | LittleEndian} {
+		raw, err := mode.Encode(s, []byte{1, 2, 3})
+		tests.Assert(t, nil, err)
+
+		var s2 Shape
+		var b []byte
+		err = mode.Decode(raw, &s2, &b)
+		tests.Assert(t, nil, err)
+		tests.AssertEqual(t, s, s2)
+		tests.AssertEqual(t, []byte{1, 2, 3}, b)
+	}
+}
+
+func TestModesLayout(t *testing.T) {
+	raw, _ := Varint.Encode([]byte{1, 2}, uint32(1))
+	tests.AssertEqual(t, []byte{2, 1, 2, 0, 0, 0, 1}, raw.Bytes())
+
+	raw, _ = LittleEndian.Encode([]byte{1, 2}, uint32(1))
+	tests.AssertEqual(t, []byte{2, 0, 0, 0, 0, 0, 0, 0, 1, 2, 1, 0, 0, 0}, raw.Bytes())
+
+	raw, _ = (Varint | LittleEndian).Encode([]byte{1, 2}, uint32(1))
+	tests.AssertEqual(t, []byte{2, 1, 2, 1, 0, 0, 0}, raw.Bytes())
+}
+
+func TestModeHeader(t *testing.T) {
+	for _, mode := range []Mode{DefaultMode, Varint, LittleEndian, Varint | LittleEndian} {
+		buf := new(bytes.Buffer)
+		(mode | View).EncodeHeader(buf)
+		mode.EncodeTo(buf, []byte{1, 2}, uint32(7))
+
+		// Decoder doesn't need to know the mode.
+		m, err := ReadMode(buf)
+		tests.Assert(t, nil, err)
+		tests.Assert(t, mode, m)
+
+		var b []byte
+		var n uint32
+		tests.Assert(t, nil, m.Decode(buf, &b, &n))
+		tests.AssertEqual(t, []byte{1, 2}, b)
+		tests.Assert(t, 7, n)
+
+		// Streams too.
+		out := new(bytes.Buffer)
+		enc := mode.NewEncoder(out)
+		enc.WriteHeader()
+		enc.Encode([]byte{3, 4})
+
+		dec := NewDecoder(out)
+		tests.Assert(t, nil, dec.ReadHeader())
+		tests.Assert(t, nil, dec.Decode(&b))
+		tests.AssertEqual(t, []byte{3, 4}, b)
+	}
+
+	// Bytes without header.
+	raw, _ := Encode([]byte{1, 2})
+	_, err := ReadMode(raw)
+	tests.Assert(t, true, errors.Is(err, ErrModeHeader))
+
+	_, err = ReadMode(bytes.NewBuffer([]byte{0xb4}))
+	tests.Assert(t, true, errors.Is(err, ErrModeHeader))
+
+	_, err = ReadMode(new(bytes.Buffer))
+	tests.Assert(t, true, errors.Is(err, ErrModeHeader))
+}
+
+func TestModesErrors(t *testing.T) {
+	// Varint length over the buffer.
+	b := []byte{}
+	err := Varint.Decode(bytes.NewBuffer([]byte{10, 1}), &b)
+	tests.Assert(t, true, errors.Is(err, ErrShortBuffer))
+
+	// Truncated varint.
+	err = Varint.Decode(bytes.NewBuffer([]byte{0x80}), &b)
+	tests.Assert(t, true, errors.Is(err, ErrShortBuffer))
+
+	// Length over limit.
+	raw, _ := Varint.Encode(make([]byte, 10))
+	dec := Decoding{Mode: Varint, MaxSliceLen: 2}.NewDecoder(raw)
+
+	err = dec.Decode(&b)
+	tests.Assert(t, true, errors.Is(err, ErrLengthLimit))
+}
+
+func TestStream(t *testing.T) {
+	s := Shape{
+		Name:   "square",
+		Points: []Point{{0, 0}, {1, 0}, {1, 1}, {0, 1}},
+		Tags:   map[string]uint64{"sides": 4},
+		Parent: &Point{2, 2},
+		Count:  4,
+	}
+	data := bytes.Repeat([]byte{7}, 5000)
+
+	for _, mode := range []Mode{DefaultMode, Varint} {
+		out := new(bytes.Buffer)
+		enc := mode.NewEncoder(out)
+
+		for i := range 10 {
+			err := enc.Encode(s, uint32(i), data)
+			tests.Assert(t, nil, err)
+		}
+
+		// Same bytes as Encode.
+		raw, _ := mode.Encode(s, uint32(0), data)
+		tests.AssertEqual(t, raw.Bytes(), out.Bytes()[:raw.Len()])
+
+		// Read it byte by byte to hit all partial reads.
+		dec := mode.NewDecoder(iotest.OneByteReader(out))
+
+		for i := range 10 {
+			var s2 Shape
+			var n uint32
+			var data2 []byte
+
+			err := dec.Decode(&s2, &n, &data2)
+			tests.Assert(t, nil, err)
+			tests.AssertEqual(t, s, s2)
+			tests.Assert(t, uint32(i), n)
+			tests.AssertEqual(t, data, data2)
+		}
+
+		var n uint32
+		tests.Assert(t, io.EOF, dec.Decode(&n))
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	// Stream ends in the middle of value.
+	raw, _ := Encode(uint64(1), []byte{1, 2, 3})
+	dec := NewDecoder(bytes.NewReader(raw.Bytes()[:raw.Len()-1]))
+
+	var n uint64
+	var b []byte
+	tests.Assert(t, nil, dec.Decode(&n))
+
+	err := dec.Decode(&b)
+	tests.Assert(t, true, errors.Is(err, ErrShortBuffer))
+
+	// Reader errors are returned as they are.
+	dec = NewDecoder(iotest.ErrReader(io.ErrClosedPipe))
+	tests.Assert(t, io.ErrClosedPipe, dec.Decode(&n))
+
+	// Corrupted length fails without waiting for more data.
+	dec = NewDecoder(bytes.NewReader([]byte{0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}))
+	err = dec.Decode(&b)
+	tests.Assert(t, true, errors.Is(err, ErrLengthLimit))
+
+	// Nothing is written if encoding fails.
+	out := new(bytes.Buffer)
+	err = NewEncoder(out).Encode(uint8(1), make(chan int))
+	tests.Assert(t, true, errors.Is(err, ErrUnsupportedType))
+	tests.Assert(t, 0, out.Len())
+
+	// Writer errors.
+	err = NewEncoder(errWriter{}).Encode(uint8(1))
+	tests.Assert(t, io.ErrShortWrite, err)
+}
+
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) { return 0, io.ErrShortWrite }
+
+type Viewed struct {
+	Data  []byte
+	Hash  *common.Hash
+	Addr  common.Address
+	Fixed []byte `bitbox:"fixed=4"`
+	Name  string
+}
+
+func TestDecodeView(t *testing.T) {
+	v := Viewed{
+		Data:  []byte{1, 2, 3},
+		Hash:  &common.Hash{1},
+		Addr:  common.Address{2},
+		Fixed: []byte{4, 5, 6, 7},
+		Name:  "view",
+	}
+
+	raw, _ := Encode(v)
+	data := raw.Bytes()
+
+	var v2 Viewed
+	err := DecodeView(bytes.NewBuffer(data), &v2)
+	tests.Assert(t, nil, err)
+	tests.AssertEqual(t, v, v2)
+
+	// Slices and byte array pointers alias the buffer, other values don't.
+	clear(data)
+	tests.AssertEqual(t, []byte{0, 0, 0}, v2.Data)
+	tests.AssertEqual(t, []byte{0, 0, 0, 0}, v2.Fixed)
+	tests.Assert(t, common.Hash{}, *v2.Hash)
+	tests.Assert(t, common.Address{2}, v2.Addr)
+	tests.Assert(t, "view", v2.Name)
+
+	// Appending doesn't overwrite the buffer.
+	raw, _ = Encode([]byte{1, 2}, []byte{3, 4})
+	var a, b []byte
+	err = DecodeView(raw, &a, &b)
+	tests.Assert(t, nil, err)
+
+	_ = append(a, 9)
+	tests.AssertEqual(t, []byte{3, 4}, b)
+
+	// Short buffers.
+	raw, _ = Encode(common.Hash{1})
+	var hash *common.Hash
+	err = DecodeView(bytes.NewBuffer(raw.Bytes()[:31]), &hash)
+	tests.Assert(t, true, errors.Is(err, ErrShortBuffer))
+
+	// Decode without View still copies.
+	raw, _ = Encode(v)
+	data = raw.Bytes()
+	err = Decode(bytes.NewBuffer(data), &v2)
+	tests.Assert(t, nil, err)
+
+	clear(data)
+	tests.AssertEqual(t, v, v2)
+}
+
+type UserV1 struct {
+	Name  string `bitbox:"id=1"`
+	Email string `bitbox:"id=2"`
+	Age   uint8  `bitbox:"id=3"`
+}
+
+// Email removed, Tags and Score added, Age moved.
+type UserV2 struct {
+	Age   uint8             `bitbox:"id=3"`
+	Name  string            `bitbox:"id=1"`
+	Tags  []string          `bitbox:"id=4"`
+	Score int64             `bitbox:"id=5,varint"`
+	Meta  map[string]string `bitbox:"-"`
+}
+
+func TestFieldIDs(t *testing.T) {
+	v1 := UserV1{Name: "alice", Email: "alice@example.com", Age: 30}
+
+	raw, err := Encode(v1)
+	tests.Assert(t, nil, err)
+
+	// Unknown fields are skipped, missing ones are zeroed.
+	v2 := UserV2{Tags: []string{"stale"}, Score: 7}
+	err = Decode(bytes.NewBuffer(raw.Bytes()), &v2)
+	tests.Assert(t, nil, err)
+	tests.AssertEqual(t, UserV2{Name: "alice", Age: 30}, v2)
+
+	// And the other way around.
+	v2 = UserV2{Name: "bob", Age: 40, Tags: []string{"admin"}, Score: -5}
+	raw, err = Encode(v2)
+	tests.Assert(t, nil, err)
+
+	v1 = UserV1{Email: "stale"}
+	err = Decode(raw, &v1)
+	tests.Assert(t, nil, err)
+	tests.AssertEqual(t, UserV1{Name: "bob", Age: 40}, v1)
+
+	for _, mode := range []Mode{DefaultMode, Varint} {
+		v, err := mode.Encode(v2)
+		tests.Assert(t, nil, err)
+
+		var v3 UserV2
+		err = mode.Decode(v, &v3)
+		tests.Assert(t, nil, err)
+		tests.AssertEqual(t, v2, v3)
+	}
+
+	// Layout.
+	raw, _ = Varint.Encode(UserV1{Name: "a", Age: 1})
+	tests.AssertEqual(t, []byte{3, 1, 2, 1, 'a', 2, 1, 0, 3, 1, 1}, raw.Bytes())
+}
+
+func TestFieldIDsErrors(t *testing.T) {
+	type missing struct {
+		A int `bitbox:"id=1"`
+		B int
+	}
+
+	type duplicate struct {
+		A int `bitbox:"id=1"`
+		B int `bitbox:"id=1"`
+	}
+
+	_, err := Encode(missing{})
+	tests.Assert(t, true, errors.Is(err, ErrInvalidTag))
+
+	_, err = Encode(duplicate{})
+	tests.Assert(t, true, errors.Is(err, ErrInvalidTag))
+
+	_, err = Encode(struct {
+		A int `bitbox:"id=0"`
+	}{})
+	tests.Assert(t, true, errors.Is(err, ErrInvalidTag))
+
+	// Field length doesn't match its type.
+	var v UserV1
+	err = Varint.Decode(bytes.NewBuffer([]byte{1, 3, 2, 30, 1}), &v)
+	tests.Assert(t, true, errors.Is(err, ErrInvalidData))
+
+	var de *DecodeError
+	tests.Assert(t, true, errors.As(err, &de))
+	tests.Assert(t, "db.UserV1.Age", de.Path)
+
+	// Truncated field.
+	raw, _ := Encode(UserV1{Name: "alice"})
+	err = Decode(bytes.NewBuffer(raw.Bytes()[:raw.Len()-1]), &v)
+	tests.Assert(t, true, errors.Is(err, ErrShortBuffer))
+}
+
+func TestNilAndEmpty(t *testing.T) {
+	RoundTripMode(t, KeepEmpty, []byte(nil))
+	RoundTripMode(t, KeepEmpty, []byte{})
+	RoundTripMode(t, KeepEmpty, []int32(nil))
+	RoundTripMode(t, KeepEmpty, []int32{})
+	RoundTripMode(t, KeepEmpty, map[string]int(nil))
+	RoundTripMode(t, KeepEmpty, map[string]int{})
+	RoundTripMode(t, KeepEmpty, [][]byte{nil, {}, {1}})
+	RoundTripMode(t, KeepEmpty, Shape{Points: []Point{}, Tags: map[string]uint64{}, Parent: &Point{}})
+
+	// Without KeepEmpty empty slices are written and decoded as nil.
+	raw, _ := Encode([]byte(nil), []byte{})
+	tests.AssertEqual(t, make([]byte, 16), raw.Bytes())
+
+	var a, b []byte
+	err := Decode(raw, &a, &b)
+	tests.Assert(t, nil, err)
+	tests.Assert(t, true, a == nil && b == nil)
+
+	// Empty slices have all bits set in length.
+	raw, _ = KeepEmpty.Encode([]byte(nil), []byte{})
+	tests.AssertEqual(t, []byte{0, 0, 0, 0, 0, 0, 0, 0, 255, 255, 255, 255, 255, 255, 255, 255}, raw.Bytes())
+
+	raw, _ = (Varint | KeepEmpty).Encode([]byte(nil), []byte{})
+	tests.AssertEqual(t, []byte{0, 255, 255, 255, 255, 255, 255, 255, 255, 255, 1}, raw.Bytes())
+
+	// Decoded as empty in any mode.
+	err = Varint.Decode(raw, &a, &b)
+	tests.Assert(t, nil, err)
+	tests.Assert(t, true, a == nil)
+	tests.Assert(t, true, b != nil && len(b) == 0)
+}
+
+func TestSliceOfStructs(t *testing.T) {
+	RoundTrip(t, []Point{{1, 2}, {3, 4}})
+	RoundTrip(t, []*Point{{1, 2}, {3, 4}})
+	RoundTrip(t, []Shape{{Name: "a", Parent: &Point{1, 1}}, {Name: "b", Points: []Point{{5, 5}}, Parent: &Point{}}})
+	RoundTripMode(t, KeepEmpty, map[string][]*Point{"a": {{1, 2}}, "b": {}})
+
+	// Elements implementing Encoder/Decoder.
+	RoundTrip(t, []TestStruct{{Data: []byte{1, 2}}, {Data: []byte{3}}})
+	RoundTrip(t, []*TestStruct{{Data: []byte{1, 2}}, {Data: []byte{3}}})
+
+	// Nil pointers in slices are decoded as zero values.
+	raw, _ := Encode([]*Point{nil, {1, 1}})
+
+	var points []*Point
+	err := Decode(raw, &points)
+	tests.Assert(t, nil, err)
+	tests.AssertEqual(t, []*Point{{}, {1, 1}}, points)
+}
+
+type fuzzValue struct {
+	Name   string
+	Data   []byte
+	Points []Point
+	Ptrs   []*Point
+	Shapes []Shape
+	Tags   map[string][]byte
+	Nested [][]int32
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add("", []byte(nil), int32(0), int32(0), uint8(0), false)
+	f.Add("shape", []byte{1, 2, 3}, int32(-1), int32(7), uint8(3), true)
+	f.Add("empty", []byte{}, int32(1<<30), int32(-1<<30), uint8(0), true)
+
+	f.Fuzz(func(t *testing.T, name string, data []byte, x, y int32, n uint8, empty bool) {
+		// Fuzzer passes nil as empty slice, only KeepEmpty keeps it.
+		if len(data) == 0 && empty {
+			data = []byte{}
+		} else if len(data) == 0 {
+			data = nil
+		}
+
+		v := fuzzValue{Name: name, Data: data}
+
+		// Zero length collections are either all nil or all empty.
+		if empty {
+			v.Points, v.Ptrs, v.Shapes = []Point{}, []*Point{}, []Shape{}
+			v.Tags, v.Nested = map[string][]byte{}, [][]int32{}
+		}
+
+		for i := range int32(n % 8) {
+			p := Point{x + i, y - i}
+
+			v.Points = append(v.Points, p)
+			v.Ptrs = append(v.Ptrs, &p)
+			v.Shapes = append(v.Shapes, Shape{Name: name, Points: v.Points, Parent: &p, Count: int(x)})
+			v.Tags = map[string][]byte{name: data, string(data): nil}
+			v.Nested = append(v.Nested, []int32{x, y}, nil)
+		}
+
+		for _, mode := range []Mode{DefaultMode, Varint, LittleEndian} {
+			if empty {
+				mode |= KeepEmpty
+			}
+
+			raw, err := mode.Encode(v)
+			tests.Assert(t, nil, err)
+
+			var result fuzzValue
+			err = mode.Decode(raw, &result)
+			tests.Assert(t, nil, err)
+			tests.Assert(t, 0, raw.Len())
+			tests.AssertEqual(t, v, result)
+		}
+	})
+}
+
+// Targets decoded by FuzzDecode, each gets fresh value.
+var fuzzTargets = []func() any{
+	func() any { return new(fuzzValue) },
+	func() any { return new(Shape) },
+	func() any { return new(Tree) },
+	func() any { return new(Tagged) },
+	func() any { return new(UserV2) },
+	func() any { return new(Viewed) },
+	func() any { return new(TestStruct) },
+	func() any { return new(*big.Int) },
+	func() any { return new(map[uint16][]string) },
+	func() any { return new([2]common.Hash) },
+}
+
+func FuzzDecode(f *testing.F) {
+	seeds := []any{
+		fuzzValue{Name: "seed", Data: []byte{1}, Points: []Point{{1, 2}}, Ptrs: []*Point{{3, 4}}},
+		Shape{Name: "triangle", Points: []Point{{0, 0}, {2, 0}, {1, 2}}, Tags: map[string]uint64{"sides": 3}},
+		Tree{1, []Tree{{2, nil}, {3, []Tree{{4, nil}}}}},
+		Tagged{Id: 300, Parent: &Point{1, 2}, Hash: []byte{1, 2, 3, 4}, Code: "pl", Counts: []int64{-1}},
+		UserV2{Name: "bob", Age: 40, Tags: []string{"admin"}, Score: -5},
+		Viewed{Data: []byte{1}, Hash: &common.Hash{1}, Fixed: []byte{1, 2, 3, 4}},
+		big.NewInt(-1000),
+		map[uint16][]string{1: {"a"}, 2: {}},
+	}
+
+	for _, mode := range []Mode{DefaultMode, Varint, LittleEndian} {
+		for _, seed := range seeds {
+			raw, err := mode.Encode(seed)
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add(raw.Bytes(), uint8(mode))
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, mode uint8) {
+		m := Mode(mode) & (Varint | LittleEndian | View)
+
+		for _, target := range fuzzTargets {
+			item := target()
+
+			err := m.Decode(bytes.NewBuffer(data), item)
+			if err == nil {
+				continue
+			}
+
+			// Errors must be typed, so callers can tell corrupted data apart.
+			var de *DecodeError
+			if !errors.As(err, &de) {
+				t.Fatalf("%T: untyped error %v", item, err)
+			}
+		}
+	})
+}
+
+type EthTx struct {
+	From    common.Address
+	To      *common.Address
+	Hash    common.Hash
+	Value   *hexutil.Big
+	Balance hexutil.U256
+	Nonce   hexutil.Uint64
+	Index   hexutil.Uint
+	Input   hexutil.Bytes
+	Logs    map[common.Hash][]byte
+	Amount  *big.Int
+	Memo    string `bitbox:"-"`
+}
+
+func TestEthereumTypes(t *testing.T) {
+	tx := EthTx{
+		From:    common.Address{1},
+		To:      &common.Address{2},
+		Hash:    common.Hash{3},
+		Value:   (*hexutil.Big)(big.NewInt(1_000_000)),
+		Balance: hexutil.U256{1 << 40},
+		Nonce:   7,
+		Index:   3,
+		Input:   hexutil.Bytes{0xca, 0xfe},
+		Logs:    map[common.Hash][]byte{{1}: {1}},
+		Amount:  big.NewInt(42),
+	}
+
+	RoundTrip(t, tx)
+
+	// hexutil.Big is encoded as big.Int.
+	raw, _ := Encode(tx.Value)
+	expected, _ := Encode(big.NewInt(1_000_000))
+	tests.AssertEqual(t, expected.Bytes(), raw.Bytes())
+}
+
+func TestToJSON(t *testing.T) {
+	tx := EthTx{
+		From:   common.Address{1},
+		Value:  (*hexutil.Big)(big.NewInt(255)),
+		Nonce:  7,
+		Input:  hexutil.Bytes{0xca, 0xfe},
+		Logs:   map[common.Hash][]byte{{1}: {1, 2}},
+		Amount: big.NewInt(42),
+	}
+
+	raw, _ := Encode(tx)
+	js, err := ToJSON(raw.Bytes(), reflect.TypeFor[EthTx]())
+	tests.Assert(t, nil, err)
+
+	expected := `{"From":"0x0100000000000000000000000000000000000000",` +
+		`"To":"0x0000000000000000000000000000000000000000",` +
+		`"Hash":"0x0000000000000000000000000000000000000000000000000000000000000000",` +
+		`"Value":"0xff","Balance":"0x0","Nonce":"0x7","Index":"0x0","Input":"0xcafe",` +
+		`"Logs":{"0x0100000000000000000000000000000000000000000000000000000000000000":"0x0102"},` +
+		`"Amount":42}`
+	tests.Assert(t, expected, string(js))
+
+	// Plain types, nil and empty collections.
+	raw, _ = (Varint | KeepEmpty).Encode(Shape{Name: "a", Points: []Point{{1, 2}}, Tags: map[string]uint64{}})
+	js, err = Varint.ToJSON(raw.Bytes(), reflect.TypeFor[Shape]())
+	tests.Assert(t, nil, err)
+	tests.Assert(t, `{"Name":"a","Closed":false,"Center":{"X":0,"Y":0},"Points":[{"X":1,"Y":2}],"Tags":{},"Parent":{"X":0,"Y":0},"Count":0,"Size":0}`, string(js))
+
+	// Control and invalid UTF-8 bytes in keys are escaped the JSON way.
+	raw, _ = Encode(map[string]int{"a\x01b": 1, "\xff": 2})
+	js, err = ToJSON(raw.Bytes(), reflect.TypeFor[map[string]int]())
+	tests.Assert(t, nil, err)
+	tests.Assert(t, true, json.Valid(js))
+	tests.Assert(t, "{\"a\\u0001b\":1,\"\ufffd\":2}", string(js))
+
+	raw, _ = Encode([]byte(nil), [][]byte{{}})
+	_, err = ToJSON(raw.Bytes(), reflect.TypeFor[[]byte]())
+	tests.Assert(t, true, errors.Is(err, ErrInvalidData))
+}
+
+func benchTx() TestTx {
+	return TestTx{
+		Type:        2,
+		To:          &common.Address{1, 2, 3},
+		From:        &common.Address{4, 5, 6},
+		Ids:         []int32{1, 2, 3, 4},
+		Value:       big.NewInt(333444),
+		Nonce:       444,
+		Hash:        common.Hash{1, 2, 3, 4},
+		ChainID:     big.NewInt(1),
+		BlockNumber: big.NewInt(666999),
+		GasUsed:     21000,
+		GasPrice:    big.NewInt(1000000000),
+		Data:        make([]byte, 128),
+	}
+}
+
+// Benchmark compiled codecs side by side with the reference
+// implementation, see bitbox_ref_test.go.
+func benchEncode(b *testing.B, elements ...any) {
+	run := func(encode func(...any) (*bytes.Buffer, error)) func(*testing.B) {
+		return func(b *testing.B) {
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				encode(elements...)
+			}
+		}
+	}
+
+	b.Run("codec", run(Encode))
+	b.Run("reflect", run(refEncode))
+}
+
+// Like benchEncode, items returns fresh values to decode into.
+func benchDecode(b *testing.B, raw *bytes.Buffer, items func() []any) {
+	run := func(decode func(*bytes.Buffer, ...any) error) func(*testing.B) {
+		return func(b *testing.B) {
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				decode(bytes.NewBuffer(raw.Bytes()), items()...)
+			}
+		}
+	}
+
+	b.Run("codec", run(Decode))
+	b.Run("reflect", run(refDecode))
+}
+
+func BenchmarkEncodeStruct(b *testing.B) {
+	benchEncode(b, benchTx())
+}
+
+func BenchmarkDecodeStruct(b *testing.B) {
+	raw, _ := Encode(benchTx())
+	benchDecode(b, raw, func() []any { return []any{&TestTx{}} })
+}
+
+func BenchmarkEncodeRecord(b *testing.B) {
+	benchEncode(b, make([]byte, 32), make([]byte, 256))
+}
+
+func BenchmarkDecodeRecord(b *testing.B) {
+	raw, _ := Encode(make([]byte, 32), make([]byte, 256))
+	benchDecode(b, raw, func() []any { return []any{new([]byte), new([]byte)} })
+}
+
+func BenchmarkEncodeShape(b *testing.B) {
+	benchEncode(b, benchShape())
+}
+
+func BenchmarkDecodeShape(b *testing.B) {
+	raw, _ := Encode(benchShape())
+	benchDecode(b, raw, func() []any { return []any{&Shape{}} })
+}
+
+func BenchmarkDecodeView(b *testing.B) {
+	raw, _ := Encode(make([]byte, 32), make([]byte, 256))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		var key, val []byte
+		DecodeView(bytes.NewBuffer(raw.Bytes()), &key, &val)
+	}
+}
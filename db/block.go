@@ -1,21 +1,45 @@
 package db
 
 import (
+	"bucketdb/db/page"
+	"errors"
 	"fmt"
 	"unsafe"
 )
 
+var (
+	// Length in block footer doesn't fit the block, ex: after torn write.
+	ErrBlockLength = errors.New("block length out of range")
+
+	// Raw and slotted APIs used on the same block.
+	ErrBlockType = errors.New("block holds different type of data")
+
+	// Block checksum doesn't match its data, ex: after torn write.
+	ErrCorruptBlock = errors.New("block is corrupted")
+)
+
 // Default file block.
+//
+// Since format 5 blocks are pages with page.Header at the start and
+// length kept in the header. Older blocks keep only length in the footer
+// at the end of block. Positions used by Block methods are relative to
+// block payload in both layouts.
 type Block struct {
 	// I dont like embedded structs but in this case
 	// it make sense. I don't want to map each field
 	// separately.
 	*footer
 
+	// Page header, nil for blocks in old layout.
+	header *page.Header
+
 	data   []byte
 	offset int64
 	Cap    int32
 
+	// Payload starts after page header.
+	start int
+
 	ReadOffset int
 }
 
@@ -23,6 +47,7 @@ type footer struct {
 	Len int32
 }
 
+// Create block in layout used before format 5, with length in footer.
 func NewBlock(data []byte, cap int32) *Block {
 	b := &Block{
 		data:       data,
@@ -37,18 +62,93 @@ func NewBlock(data []byte, cap int32) *Block {
 	return b
 }
 
+// Open block stored as a page. Pages which were never written are
+// initialized on first write.
+func OpenBlock(data []byte) (*Block, error) {
+	h, err := page.Of(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBlockLength, err)
+	}
+
+	b := &Block{
+		data:   data,
+		Cap:    int32(len(data)),
+		header: h,
+		start:  page.HeaderSize,
+	}
+
+	// Length is kept in the header.
+	b.footer = (*footer)(unsafe.Pointer(&h.Len))
+
+	return b, nil
+}
+
+// Type of block data, Raw for old blocks.
+func (b *Block) Type() page.Type {
+	if b.header == nil {
+		return page.Raw
+	}
+
+	return b.header.Type
+}
+
+// Check that block holds data of given type, marking empty blocks.
+func (b *Block) use(t page.Type) error {
+	if b.header == nil {
+		return nil
+	}
+
+	switch b.header.Type {
+	case t:
+		return nil
+	case page.Empty:
+		b.header.Init(t, len(b.data))
+		return nil
+	}
+
+	return ErrBlockType
+}
+
+// Update free space in page header after changing the block.
+func (b *Block) changed() {
+	if b.header == nil {
+		return
+	}
+
+	if b.header.Type == page.Slotted {
+		b.header.Free = int32(b.Free())
+		return
+	}
+
+	b.header.Free = int32(b.capacity() - int(b.footer.Len))
+}
+
+// Block bytes available for data, without header or footer.
+func (b *Block) payload() []byte {
+	return b.data[b.start : b.start+b.capacity()]
+}
+
 // Write data to block.
 func (b *Block) Write(src []byte) (int, error) {
+	if !b.valid() {
+		return 0, ErrBlockLength
+	}
+
+	if err := b.use(page.Raw); err != nil {
+		return 0, err
+	}
+
 	// Check if we have enough space in block.
 	if b.isFull(int(b.footer.Len) + len(src)) {
 		return 0, fmt.Errorf("EOF")
 	}
 
 	// Copy data to block.
-	copy(b.data[b.footer.Len:], src)
+	copy(b.payload()[b.footer.Len:], src)
 
 	// Update block size.
 	b.footer.Len += int32(len(src))
+	b.changed()
 
 	return 0, nil
 }
@@ -59,7 +159,7 @@ func (b *Block) Read(dst []byte) bool {
 		return false
 	}
 
-	n := copy(dst, b.data[b.ReadOffset:])
+	n := copy(dst, b.payload()[b.ReadOffset:])
 	if n != len(dst) {
 		return false
 	}
@@ -68,18 +168,46 @@ func (b *Block) Read(dst []byte) bool {
 	return true
 }
 
+// Overwrite block data at given position.
+func (b *Block) WriteAt(src []byte, pos int) (int, error) {
+	if !b.valid() {
+		return 0, ErrBlockLength
+	}
+
+	if pos < 0 || pos+len(src) > int(b.footer.Len) {
+		return 0, fmt.Errorf("EOF")
+	}
+
+	return copy(b.payload()[pos:], src), nil
+}
+
 // Read footer from the end of the block.
 func (b *Block) ReadFooter(footer []byte) {
 	i := len(b.data) - len(footer)
-	Decode2(b.data[i:], footer)
+	copy(footer, b.data[i:])
 }
 
 // Write footer to the end of the block.
 func (b *Block) WriteFooter(footer []byte) {
 	i := len(b.data) - len(footer)
-	Decode2(footer, b.data[i:])
+	copy(b.data[i:], footer)
 }
 
 func (b *Block) isFull(n int) bool {
-	return n > int(b.Cap)-4 // footer size
+	return n > b.capacity()
+}
+
+// Space for data, without header or footer. Cap is trusted only as far
+// as block data goes.
+func (b *Block) capacity() int {
+	if b.header != nil {
+		return min(int(b.Cap), len(b.data)) - b.start
+	}
+
+	return min(int(b.Cap), len(b.data)) - 4 // footer size
+}
+
+// Check if length stored in footer fits the block.
+func (b *Block) valid() bool {
+	return b.footer.Len >= 0 && int(b.footer.Len) <= b.capacity()
 }
@@ -0,0 +1,336 @@
+package db
+
+import (
+	"bucketdb/db/page"
+	"encoding/binary"
+	"errors"
+	"slices"
+)
+
+var (
+	ErrBlockFull = errors.New("block is full")
+	ErrNoSlot    = errors.New("slot doesn't exist")
+)
+
+// Slotted page API. Records are appended from the start of the block,
+// slot directory grows from the footer towards them:
+//
+//	records... | free space | slot n-1 ... slot 0 | slot count | footer
+//
+// Each slot keeps record offset and size (int32, little endian), deleted
+// slots have size -1 and are reused by Append. Footer Len marks the end
+// of records. Space of deleted records is reclaimed by compacting the
+// block, which moves records but keeps their slot numbers.
+//
+// Slotted and raw Write/Read APIs can't be mixed on the same block,
+// pages report ErrBlockType if they are.
+const (
+	slotSize    = 8
+	slotDeleted = -1
+)
+
+// Append record to block, returning its slot number.
+func (b *Block) Append(record []byte) (int, error) {
+	count, err := b.slotCount()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := b.use(page.Slotted); err != nil {
+		return 0, err
+	}
+
+	slot := b.freeSlot(count)
+
+	need := len(record)
+	if slot == count {
+		need += slotSize
+	}
+
+	if need > b.gap(count) {
+		if need > b.gap(count)+b.dead(count) {
+			return 0, ErrBlockFull
+		}
+
+		err := b.checkSlots(count)
+		if err != nil {
+			return 0, err
+		}
+		b.compact(count)
+	}
+
+	off := int(b.footer.Len)
+	copy(b.payload()[off:], record)
+	b.footer.Len += int32(len(record))
+
+	if slot == count {
+		b.setSlotCount(count + 1)
+	}
+	b.setSlot(slot, off, len(record))
+	b.changed()
+
+	return slot, nil
+}
+
+// Get record stored in slot. Returned bytes point into the block, so
+// they are valid only until block is modified.
+func (b *Block) Get(slot int) ([]byte, error) {
+	off, size, err := b.record(slot)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.payload()[off : off+size : off+size], nil
+}
+
+// Delete record stored in slot. Its space is reclaimed by the next
+// Append which needs it.
+func (b *Block) Delete(slot int) error {
+	off, size, err := b.record(slot)
+	if err != nil {
+		return err
+	}
+
+	// Last record can be dropped right away.
+	if off+size == int(b.footer.Len) {
+		b.footer.Len = int32(off)
+	}
+	b.setSlot(slot, 0, slotDeleted)
+
+	// Trim deleted slots from the end of directory.
+	count, _ := b.slotCount()
+	for count > 0 {
+		if _, size := b.slot(count - 1); size != slotDeleted {
+			break
+		}
+		count--
+	}
+	b.setSlotCount(count)
+	b.changed()
+
+	return nil
+}
+
+// Number of bytes the next Append can take.
+func (b *Block) Free() int {
+	count, err := b.slotCount()
+	if err != nil {
+		return 0
+	}
+
+	free := b.gap(count) + b.dead(count)
+	if b.freeSlot(count) == count {
+		free -= slotSize
+	}
+
+	return max(free, 0)
+}
+
+// Iterator over records of a block, in slot order.
+type BlockIter struct {
+	block *Block
+	slot  int
+	count int
+	data  []byte
+}
+
+// Iterate over all records in block:
+//
+//	it := b.Iter()
+//	for it.Next() {
+//		fmt.Println(it.Slot(), it.Record())
+//	}
+func (b *Block) Iter() *BlockIter {
+	it := &BlockIter{block: b, slot: -1}
+
+	// Raw blocks have no records.
+	if b.slotted() == nil {
+		it.count, _ = b.slotCount()
+	}
+
+	return it
+}
+
+// Move to the next record, deleted slots are skipped.
+func (it *BlockIter) Next() bool {
+	for it.slot+1 < it.count {
+		it.slot++
+
+		data, err := it.block.Get(it.slot)
+		if err == nil {
+			it.data = data
+			return true
+		}
+	}
+
+	it.data = nil
+	return false
+}
+
+// Slot of the current record.
+func (it *BlockIter) Slot() int {
+	return it.slot
+}
+
+// Current record, valid until block is modified.
+func (it *BlockIter) Record() []byte {
+	return it.data
+}
+
+// Get offset and size of live record, checking that it fits the block.
+func (b *Block) record(slot int) (int, int, error) {
+	err := b.slotted()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	count, err := b.slotCount()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if slot < 0 || slot >= count {
+		return 0, 0, ErrNoSlot
+	}
+
+	off, size := b.slot(slot)
+	if size == slotDeleted {
+		return 0, 0, ErrNoSlot
+	}
+
+	if off < 0 || size < 0 || off+size > int(b.footer.Len) {
+		return 0, 0, ErrBlockLength
+	}
+
+	return off, size, nil
+}
+
+// Check that block isn't used by raw API. Empty blocks and blocks
+// without header can hold slots.
+func (b *Block) slotted() error {
+	if b.header == nil || b.header.Type == page.Slotted || b.header.Type == page.Empty {
+		return nil
+	}
+
+	return ErrBlockType
+}
+
+// Get number of slots, checking that directory fits the block.
+func (b *Block) slotCount() (int, error) {
+	if !b.valid() || b.capacity() < 4 {
+		return 0, ErrBlockLength
+	}
+
+	end := b.capacity()
+	count := int(int32(binary.LittleEndian.Uint32(b.payload()[end-4:])))
+
+	if count < 0 || count > (end-4-int(b.footer.Len))/slotSize {
+		return 0, ErrBlockLength
+	}
+
+	return count, nil
+}
+
+func (b *Block) setSlotCount(count int) {
+	end := b.capacity()
+	binary.LittleEndian.PutUint32(b.payload()[end-4:], uint32(count))
+}
+
+// Position of slot in directory.
+func (b *Block) slotPos(slot int) int {
+	return b.capacity() - 4 - (slot+1)*slotSize
+}
+
+func (b *Block) slot(slot int) (int, int) {
+	pos := b.slotPos(slot)
+	p := b.payload()
+
+	off := int32(binary.LittleEndian.Uint32(p[pos:]))
+	size := int32(binary.LittleEndian.Uint32(p[pos+4:]))
+
+	return int(off), int(size)
+}
+
+func (b *Block) setSlot(slot, off, size int) {
+	pos := b.slotPos(slot)
+	p := b.payload()
+
+	binary.LittleEndian.PutUint32(p[pos:], uint32(int32(off)))
+	binary.LittleEndian.PutUint32(p[pos+4:], uint32(int32(size)))
+}
+
+// First deleted slot, or count if there is none.
+func (b *Block) freeSlot(count int) int {
+	for i := 0; i < count; i++ {
+		if _, size := b.slot(i); size == slotDeleted {
+			return i
+		}
+	}
+
+	return count
+}
+
+// Contiguous free space between records and slot directory.
+func (b *Block) gap(count int) int {
+	return b.slotPos(count-1) - int(b.footer.Len)
+}
+
+// Space taken by deleted records, reclaimed by compact.
+func (b *Block) dead(count int) int {
+	live := 0
+
+	for i := 0; i < count; i++ {
+		if _, size := b.slot(i); size != slotDeleted {
+			live += size
+		}
+	}
+
+	return int(b.footer.Len) - live
+}
+
+// Check that all live records fit the block, before moving them.
+func (b *Block) checkSlots(count int) error {
+	for i := 0; i < count; i++ {
+		off, size := b.slot(i)
+		if size == slotDeleted {
+			continue
+		}
+
+		if off < 0 || size < 0 || off+size > int(b.footer.Len) {
+			return ErrBlockLength
+		}
+	}
+
+	return nil
+}
+
+// Move live records to the start of block, in order of their offsets.
+func (b *Block) compact(count int) {
+	slots := []int{}
+
+	for i := 0; i < count; i++ {
+		if _, size := b.slot(i); size != slotDeleted {
+			slots = append(slots, i)
+		}
+	}
+
+	slices.SortFunc(slots, func(x, y int) int {
+		ox, _ := b.slot(x)
+		oy, _ := b.slot(y)
+		return ox - oy
+	})
+
+	p := b.payload()
+
+	end := 0
+	for _, i := range slots {
+		off, size := b.slot(i)
+
+		copy(p[end:], p[off:off+size])
+		b.setSlot(i, end, size)
+		end += size
+	}
+
+	clear(p[end:b.footer.Len])
+	b.footer.Len = int32(end)
+}
@@ -1,7 +1,10 @@
 package db
 
 import (
+	"bucketdb/db/page"
 	"bucketdb/tests"
+	"bytes"
+	"errors"
 	"testing"
 )
 
@@ -39,3 +42,223 @@ func TestBlockWriteRead(t *testing.T) {
 		tests.Assert(t, a, res)
 	}
 }
+
+func TestOpenBlock(t *testing.T) {
+	data := make([]byte, 64)
+
+	b, err := OpenBlock(data)
+	tests.AssertEqual(t, nil, err)
+	tests.Assert(t, page.Empty, b.Type())
+
+	a := uint32(1337)
+	b.Write(ToBytes(&a))
+
+	// Length and free space are kept in page header.
+	h, _ := page.Of(data)
+	tests.Assert(t, page.Raw, h.Type)
+	tests.Assert(t, 4, h.Len)
+	tests.Assert(t, int32(64-page.HeaderSize-4), h.Free)
+
+	b, _ = OpenBlock(data)
+	res := uint32(0)
+	b.Read(ToBytes(&res))
+	tests.Assert(t, a, res)
+
+	// Raw block can't hold records.
+	_, err = b.Append([]byte("foo"))
+	tests.AssertEqual(t, ErrBlockType, err)
+
+	_, err = b.Get(0)
+	tests.AssertEqual(t, ErrBlockType, err)
+	tests.AssertEqual(t, ErrBlockType, b.Delete(0))
+	tests.Assert(t, false, b.Iter().Next())
+}
+
+func TestOpenBlockSlotted(t *testing.T) {
+	data := make([]byte, 128)
+
+	b, _ := OpenBlock(data)
+	slot, err := b.Append([]byte("foo"))
+	tests.AssertEqual(t, nil, err)
+	tests.Assert(t, page.Slotted, b.Type())
+
+	h, _ := page.Of(data)
+	tests.Assert(t, int32(b.Free()), h.Free)
+
+	b, _ = OpenBlock(data)
+	rec, _ := b.Get(slot)
+	tests.AssertEqual(t, []byte("foo"), rec)
+
+	_, err = b.Write([]byte("bar"))
+	tests.AssertEqual(t, ErrBlockType, err)
+}
+
+func TestOpenBlockCorrupted(t *testing.T) {
+	data := make([]byte, 64)
+
+	b, _ := OpenBlock(data)
+	b.Write([]byte("foo"))
+
+	h, _ := page.Of(data)
+	h.Len = 1000
+
+	_, err := OpenBlock(data)
+	tests.Assert(t, true, errors.Is(err, ErrBlockLength))
+
+	_, err = OpenBlock(make([]byte, 8))
+	tests.Assert(t, true, errors.Is(err, page.ErrInvalidHeader))
+}
+
+func TestBlockSlots(t *testing.T) {
+	b := NewBlock(make([]byte, 64), 64)
+
+	// 64 - footer - slot count
+	tests.Assert(t, 56-slotSize, b.Free())
+
+	s0, err := b.Append([]byte("foo"))
+	tests.Assert(t, nil, err)
+	s1, _ := b.Append([]byte("barbaz"))
+	s2, _ := b.Append([]byte{})
+
+	tests.Assert(t, 0, s0)
+	tests.Assert(t, 1, s1)
+	tests.Assert(t, 2, s2)
+
+	val, err := b.Get(s1)
+	tests.Assert(t, nil, err)
+	tests.Assert(t, "barbaz", string(val))
+
+	val, _ = b.Get(s2)
+	tests.Assert(t, 0, len(val))
+
+	// Deleted slots are reused.
+	tests.Assert(t, nil, b.Delete(s0))
+	_, err = b.Get(s0)
+	tests.Assert(t, ErrNoSlot, err)
+	tests.Assert(t, ErrNoSlot, b.Delete(s0))
+
+	s3, _ := b.Append([]byte("qux"))
+	tests.Assert(t, s0, s3)
+
+	slots := []int{}
+	records := []string{}
+
+	it := b.Iter()
+	for it.Next() {
+		slots = append(slots, it.Slot())
+		records = append(records, string(it.Record()))
+	}
+
+	tests.AssertEqual(t, []int{0, 1, 2}, slots)
+	tests.AssertEqual(t, []string{"qux", "barbaz", ""}, records)
+
+	// Slots out of range.
+	_, err = b.Get(3)
+	tests.Assert(t, ErrNoSlot, err)
+	_, err = b.Get(-1)
+	tests.Assert(t, ErrNoSlot, err)
+}
+
+func TestBlockSlotsCompact(t *testing.T) {
+	b := NewBlock(make([]byte, 64), 64)
+
+	// 3 slots take 24 bytes, 32 bytes left for records.
+	b.Append(bytes.Repeat([]byte{1}, 10))
+	b.Append(bytes.Repeat([]byte{2}, 10))
+	b.Append(bytes.Repeat([]byte{3}, 12))
+
+	_, err := b.Append([]byte{4})
+	tests.Assert(t, ErrBlockFull, err)
+
+	// Space of the first record can be reused only after compaction.
+	b.Delete(0)
+	tests.Assert(t, 10, b.Free())
+
+	slot, err := b.Append(bytes.Repeat([]byte{4}, 10))
+	tests.Assert(t, nil, err)
+	tests.Assert(t, 0, slot)
+	tests.Assert(t, 0, b.Free())
+
+	for i, expected := range []byte{4, 2, 3} {
+		val, _ := b.Get(i)
+		tests.Assert(t, expected, val[0])
+	}
+
+	// Deleting trailing slots frees their directory entries too.
+	b.Delete(2)
+	b.Delete(1)
+	tests.Assert(t, 56-slotSize-10-slotSize, b.Free())
+}
+
+func TestBlockSlotsCorrupted(t *testing.T) {
+	b := NewBlock(make([]byte, 64), 64)
+	b.Append([]byte("foo"))
+
+	// Slot pointing past the end of records.
+	b.setSlot(0, 10, 3)
+	_, err := b.Get(0)
+	tests.Assert(t, ErrBlockLength, err)
+
+	// Slot count over directory space.
+	b.setSlotCount(100)
+	_, err = b.Append([]byte("bar"))
+	tests.Assert(t, ErrBlockLength, err)
+	tests.Assert(t, false, b.Iter().Next())
+}
+
+func FuzzBlockRead(f *testing.F) {
+	f.Add(make([]byte, 20), []byte{4, 4, 8})
+	f.Add([]byte{1, 2, 3, 4, 5, 6, 7, 8, 255, 255, 255, 127}, []byte{0, 4, 12})
+	f.Add([]byte{1, 2, 3, 4, 5, 6, 7, 8, 0, 0, 0, 128}, []byte{1, 2, 3})
+
+	f.Fuzz(func(t *testing.T, data []byte, ops []byte) {
+		// Block must fit at least its footer.
+		if len(data) < 4 {
+			return
+		}
+
+		b := NewBlock(data, int32(len(data)))
+
+		for _, op := range ops {
+			size := int(op % 16)
+
+			switch op >> 6 {
+			case 0:
+				b.Read(make([]byte, size))
+			case 1:
+				b.Write(make([]byte, size))
+			case 2, 3:
+				b.WriteAt(make([]byte, size), int(op%32)-8)
+			}
+		}
+	})
+}
+
+func FuzzBlockSlots(f *testing.F) {
+	f.Add(make([]byte, 64), []byte{3, 10, 130, 5, 129})
+	f.Add([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 255, 255, 255, 127, 3, 0, 0, 0}, []byte{1, 128, 64})
+
+	f.Fuzz(func(t *testing.T, data []byte, ops []byte) {
+		if len(data) < 4 {
+			return
+		}
+
+		b := NewBlock(data, int32(len(data)))
+
+		for _, op := range ops {
+			switch op >> 6 {
+			case 0, 1:
+				b.Append(bytes.Repeat([]byte{op}, int(op%32)))
+			case 2:
+				b.Delete(int(op % 8))
+			case 3:
+				b.Get(int(op % 8))
+			}
+		}
+
+		for it := b.Iter(); it.Next(); {
+			it.Record()
+		}
+		b.Free()
+	})
+}
@@ -1,33 +1,590 @@
 package db
 
 import (
+	"bucketdb/db/crypt"
+	"bucketdb/db/wal"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
 	"path/filepath"
+	"sync"
+	"time"
 )
 
 type Collection struct {
 	name string
 	root string
 
+	// On-disk format version of collection files.
+	format int
+	opts   []Option
+
+	// Guards keys, they can be swapped when collection is reloaded.
+	mu   sync.RWMutex
 	keys *Keys
+
+	// Log for transactions.
+	wal *wal.Wal
+
+	// Serializes writers, compaction holds it for its whole duration.
+	wmu sync.Mutex
+
+	// Secondary indexes by name.
+	indexes map[string]*secondary
+
+	// Indexes stored on disk, but not created yet, were marked as stale,
+	// see markStale.
+	marked bool
+}
+
+func OpenCollection(name string, root string, opts ...Option) (*Collection, error) {
+	c := &Collection{name: name, root: root, opts: opts, indexes: map[string]*secondary{}}
+
+	var err error
+
+	c.format, err = ReadFormat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	// New collections and the ones which don't need migration.
+	if upgradable(c.format) {
+		err = WriteFormat(root, FormatVersion)
+		if err != nil {
+			return nil, err
+		}
+		c.format = FormatVersion
+	}
+
+	err = c.open()
+	if err != nil {
+		return nil, errors.Join(err, c.close())
+	}
+
+	return c, nil
+}
+
+// Default size of the transaction log, see Options.WalSize.
+const DefaultWalSize = 4 << 20
+
+// Open collection files and apply logged transactions.
+func (c *Collection) open() error {
+	var err error
+
+	err = c.openKeys()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(c.root, "wal", "txn.wal")
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	o := newOptions(c.opts...)
+
+	c.wal, err = wal.Open(path, o.WalSize)
+	if err != nil {
+		return err
+	}
+
+	if o.Keys != nil {
+		c.wal.Cipher = crypt.New(o.Keys)
+	}
+
+	return c.recover()
+}
+
+func (c *Collection) openKeys() error {
+	var err error
+
+	c.format, err = ReadFormat(c.root)
+	if err != nil {
+		return err
+	}
+
+	opts := append([]Option{}, c.opts...)
+	opts = append(opts, WithFormat(c.format))
+
+	c.keys, err = OpenKeys(DataDir(c.root), IndexDir(c.root), opts...)
+	return err
+}
+
+// Close collection files. All files are closed even if some of them
+// fail, files which weren't opened are skipped. Secondary indexes are
+// dropped, they must be created again after collection is reopened.
+func (c *Collection) close() error {
+	var errs []error
+
+	if c.keys != nil {
+		errs = append(errs, c.keys.Close())
+	}
+
+	for _, idx := range c.indexes {
+		errs = append(errs, idx.keys.Close())
+	}
+	c.indexes = map[string]*secondary{}
+	c.marked = false
+
+	if c.wal != nil {
+		errs = append(errs, c.wal.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// Apply transactions which were logged but not applied before crash.
+func (c *Collection) recover() error {
+	// Logs are applied after collection is migrated.
+	if c.format != FormatVersion {
+		return nil
+	}
+
+	var applyErr error
+
+	err := c.wal.Map(func(log []byte) {
+		if applyErr == nil {
+			applyErr = c.apply(log)
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if applyErr != nil {
+		return applyErr
+	}
+
+	return c.wal.Reset()
+}
+
+// Log transaction and apply it. Collection must be locked.
+func (c *Collection) commit(log []byte) error {
+	err := c.wal.Append(log)
+	if err != nil {
+		return err
+	}
+
+	err = c.apply(log)
+	if err != nil {
+		return err
+	}
+
+	return c.wal.Reset()
 }
 
-func OpenCollection(name string, root string) *Collection {
-	c := &Collection{name: name, root: root}
+// Directory with collection data files.
+func DataDir(root string) *Directory {
+	return Dir(filepath.Join(root, "keys", "data"), 10_000, "bin")
+}
 
-	c.keys, _ = OpenKeys(
-		Dir(filepath.Join(root, "keys", "data"), 10_000, "bin"),
-		Dir(filepath.Join(root, "keys", "index"), 10_000, "bin"),
-	)
+// Directory with collection index files.
+func IndexDir(root string) *Directory {
+	return Dir(filepath.Join(root, "keys", "index"), 10_000, "bin")
+}
+
+// Collection name.
+func (c *Collection) Name() string {
+	return c.name
+}
 
-	return c
+// Collection root directory.
+func (c *Collection) Root() string {
+	return c.root
+}
+
+// Options the collection was opened with.
+func (c *Collection) Options() []Option {
+	return c.opts
+}
+
+// On-disk format version the collection was opened with.
+func (c *Collection) Format() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.format
 }
 
 // Set key.
 func (c *Collection) Set(key, val []byte) (*Offset, error) {
-	return c.keys.Set(key, val)
+	c.lock()
+	defer c.unlock()
+
+	return c.set(key, val, 0)
+}
+
+// Set key which expires after given ttl.
+func (c *Collection) SetWithTTL(key, val []byte, ttl time.Duration) (*Offset, error) {
+	c.lock()
+	defer c.unlock()
+
+	return c.set(key, val, ttl)
+}
+
+// Delete key.
+func (c *Collection) Delete(key []byte) error {
+	c.lock()
+	defer c.unlock()
+
+	return c.delete(key)
+}
+
+// Set key only if its current value is equal to old.
+// Return false if key is missing or has a different value.
+func (c *Collection) CompareAndSwap(key, old, new []byte) (bool, error) {
+	c.lock()
+	defer c.unlock()
+
+	val, err := c.keys.Get(key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+
+	if err != nil || !bytes.Equal(val, old) {
+		return false, err
+	}
+
+	_, err = c.set(key, new, 0)
+	return err == nil, err
+}
+
+// Set key only if it doesn't exist yet.
+func (c *Collection) SetIfAbsent(key, val []byte) (bool, error) {
+	return c.SetIfVersion(key, val, 0)
+}
+
+// Set key only if its current version is equal to given one.
+// Missing keys have version 0.
+func (c *Collection) SetIfVersion(key, val []byte, version uint32) (bool, error) {
+	c.lock()
+	defer c.unlock()
+
+	current, err := c.keys.Version(key)
+	if err != nil || current != version {
+		return false, err
+	}
+
+	_, err = c.set(key, val, 0)
+	return err == nil, err
 }
 
 // Get key.
 func (c *Collection) Get(key []byte) ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	return c.keys.Get(key)
 }
+
+// Iterate all keys and values. Writers are blocked during iteration,
+// so collection must not be modified in fn.
+func (c *Collection) Each(fn func(key, val []byte) error) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.keys.Each(fn)
+}
+
+// Get key together with its version.
+func (c *Collection) GetWithVersion(key []byte) ([]byte, uint32, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.keys.GetWithVersion(key)
+}
+
+// Close collection files.
+func (c *Collection) Close() error {
+	c.lock()
+	defer c.unlock()
+
+	return c.close()
+}
+
+// Reopen collection files, ex: after they were rewritten by migration.
+// Secondary indexes must be created again, see CreateIndex.
+func (c *Collection) Reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.reload()
+}
+
+// Swap collection keys with the ones stored in dir, ex: rewritten by
+// migration or compaction. Readers are blocked only for the time of
+// renaming directories.
+func (c *Collection) Swap(dir string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.keys.Close()
+	if err != nil {
+		return err
+	}
+
+	// Files are moved back if swap fails, collection keeps serving
+	// from the old ones.
+	err = c.swap(dir)
+	if err != nil {
+		return errors.Join(err, c.openKeys())
+	}
+
+	err = c.openKeys()
+	if err != nil {
+		return err
+	}
+
+	// Logs skipped while collection was in old format.
+	err = c.recover()
+	if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(filepath.Join(c.root, "keys.old"))
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(dir)
+}
+
+// Move keys and format file from dir to collection root. Old keys are
+// kept in keys.old, they are moved back if any rename fails.
+func (c *Collection) swap(dir string) error {
+	keys := filepath.Join(c.root, "keys")
+	old := keys + ".old"
+
+	// Leftover of swap which failed to clean up.
+	err := os.RemoveAll(old)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(keys, old)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(filepath.Join(dir, "keys"), keys)
+	if err != nil {
+		return errors.Join(err, os.Rename(old, keys))
+	}
+
+	// Old format file is replaced only if everything else is in place.
+	err = os.Rename(filepath.Join(dir, FormatFile), filepath.Join(c.root, FormatFile))
+	if err != nil {
+		return errors.Join(err, os.Rename(keys, filepath.Join(dir, "keys")), os.Rename(old, keys))
+	}
+
+	return nil
+}
+
+// Rewrite live records into new files and swap them with the current ones.
+//
+// Overwritten, deleted and expired records are dropped and all records
+// are encrypted again with the current key, so it's used for key rotation
+// too. Reads are served from the old files, writers wait until compaction
+// is done.
+func (c *Collection) Compact() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.mu.RLock()
+	keys, format := c.keys, c.format
+	c.mu.RUnlock()
+
+	if format != FormatVersion {
+		return ErrOutdatedFormat
+	}
+
+	tmp := c.root + ".compact"
+	err := os.RemoveAll(tmp)
+	if err != nil {
+		return err
+	}
+
+	// New files keep block size of the current ones.
+	opts := append([]Option{}, c.opts...)
+	opts = append(opts, WithBlockSize(int(keys.index.BlockSize())))
+
+	dst, err := OpenKeys(DataDir(tmp), IndexDir(tmp), opts...)
+	if err != nil {
+		return err
+	}
+
+	err = keys.CopyTo(dst)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+
+	err = dst.Close()
+	if err != nil {
+		return err
+	}
+
+	err = WriteFormat(tmp, FormatVersion)
+	if err != nil {
+		return err
+	}
+
+	return c.Swap(tmp)
+}
+
+// Delete all expired keys. Return the number of deleted keys.
+func (c *Collection) Reap() (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	// Find expired keys without blocking readers.
+	c.mu.RLock()
+	expired, err := c.keys.Expired()
+	c.mu.RUnlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range expired {
+		err := c.delete(key)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(expired), nil
+}
+
+// Rebuild corrupted index blocks from data files, ex: after torn write
+// on power loss. Return the number of repaired blocks and keys indexed
+// again, deleted keys may come back, see Keys.Repair.
+//
+// Secondary indexes aren't repaired, they can be rebuilt by removing
+// their directory before CreateIndex.
+func (c *Collection) Repair() (int, [][]byte, error) {
+	c.lock()
+	defer c.unlock()
+
+	return c.keys.Repair()
+}
+
+// Periodically delete expired keys in background. Call returned
+// function to stop the reaper. Errors are reported to the handler set
+// with WithErrorHandler.
+func (c *Collection) StartReaper(interval time.Duration) (stop func()) {
+	onError := newOptions(c.opts...).OnError
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_, err := c.Reap()
+				if err != nil {
+					onError(fmt.Errorf("collection %s: reaper: %w", c.name, err))
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// Set key and update secondary indexes. Ttl 0 means key never expires.
+// Collection must be locked.
+func (c *Collection) set(key, val []byte, ttl time.Duration) (*Offset, error) {
+	var expires int64
+	if ttl != 0 {
+		expires = c.keys.now().Add(ttl).UnixNano()
+	}
+
+	return c.setVersion(key, val, expires, 0)
+}
+
+// Set key with given expiration time and version, see Keys.set.
+// Collection must be locked.
+func (c *Collection) setVersion(key, val []byte, expires int64, version uint32) (*Offset, error) {
+	err := c.markStale()
+	if err != nil {
+		return nil, err
+	}
+
+	old, err := c.current(key)
+	if err != nil {
+		return nil, err
+	}
+
+	off, err := c.keys.set(key, val, expires, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return off, c.reindex(key, old, val)
+}
+
+// Delete key and update secondary indexes. Collection must be locked.
+func (c *Collection) delete(key []byte) error {
+	err := c.markStale()
+	if err != nil {
+		return err
+	}
+
+	old, err := c.current(key)
+	if err != nil {
+		return err
+	}
+
+	err = c.keys.Delete(key)
+	if err != nil {
+		return err
+	}
+
+	return c.reindex(key, old, nil)
+}
+
+// Get current value of the key, including expired one, so it can be
+// removed from secondary indexes. Returns nil if there are no indexes.
+func (c *Collection) current(key []byte) ([]byte, error) {
+	if len(c.indexes) == 0 {
+		return nil, nil
+	}
+
+	val, err := c.keys.current(key)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+
+	return val, err
+}
+
+// Lock collection for writing, readers are blocked too.
+func (c *Collection) lock() {
+	c.wmu.Lock()
+	c.mu.Lock()
+}
+
+func (c *Collection) unlock() {
+	c.mu.Unlock()
+	c.wmu.Unlock()
+}
+
+func (c *Collection) reload() error {
+	err := c.close()
+	if err != nil {
+		return err
+	}
+
+	return c.open()
+}
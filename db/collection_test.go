@@ -1,13 +1,19 @@
 package db
 
 import (
+	"bucketdb/db/crypt"
 	"bucketdb/tests"
+	"bytes"
+	"fmt"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestCollectionSetGet(t *testing.T) {
-	c := OpenCollection("test", "./test")
+	c, _ := OpenCollection("test", "./test")
 	defer os.RemoveAll("./test")
 
 	c.Set([]byte("key"), []byte("Hello World"))
@@ -15,3 +21,305 @@ func TestCollectionSetGet(t *testing.T) {
 
 	tests.Assert(t, "Hello World", string(val))
 }
+
+func TestCollectionEncryption(t *testing.T) {
+	ring := crypt.NewKeyRing(1, bytes.Repeat([]byte{1}, 32))
+
+	c, _ := OpenCollection("test", "./test", WithEncryption(ring), WithIndexEncryption())
+	defer os.RemoveAll("./test")
+
+	for i := 0; i < 100; i++ {
+		c.Set([]byte(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("val_%d", i)))
+	}
+
+	// Nothing should be stored in plain text.
+	raw, _ := os.ReadFile("./test/keys/data/1/1.bin")
+	tests.Assert(t, -1, bytes.Index(raw, []byte("val_10")))
+
+	val, _ := c.Get([]byte("key_10"))
+	tests.Assert(t, "val_10", string(val))
+
+	// Rotate key and re-encrypt all records.
+	ring.Rotate(2, bytes.Repeat([]byte{2}, 32))
+	tests.Assert(t, nil, c.Compact())
+
+	// Old key is not needed anymore.
+	c.Close()
+	ring = crypt.NewKeyRing(2, bytes.Repeat([]byte{2}, 32))
+	c, _ = OpenCollection("test", "./test", WithEncryption(ring), WithIndexEncryption())
+
+	for i := 0; i < 100; i++ {
+		val, err := c.Get([]byte(fmt.Sprintf("key_%d", i)))
+		tests.Assert(t, nil, err)
+		tests.Assert(t, fmt.Sprintf("val_%d", i), string(val))
+	}
+}
+
+func TestCollectionCompact(t *testing.T) {
+	c, _ := OpenCollection("test", "./test")
+	defer os.RemoveAll("./test")
+
+	c.Set([]byte("foo"), []byte("Hello"))
+	c.Set([]byte("bar"), []byte("World"))
+
+	before, _ := os.Stat("./test/keys/data/1/1.bin")
+
+	// Compaction shouldn't change anything.
+	tests.Assert(t, nil, c.Compact())
+
+	after, _ := os.Stat("./test/keys/data/1/1.bin")
+	tests.Assert(t, before.Size(), after.Size())
+
+	val, _ := c.Get([]byte("bar"))
+	tests.Assert(t, "World", string(val))
+
+	// Collection is still writable.
+	c.Set([]byte("baz"), []byte("!"))
+	val, _ = c.Get([]byte("baz"))
+	tests.Assert(t, "!", string(val))
+}
+
+func TestCollectionBlockSize(t *testing.T) {
+	c, _ := OpenCollection("test", "./test", WithBlockSize(8<<10))
+	defer os.RemoveAll("./test")
+
+	c.Set([]byte("foo"), []byte("Hello"))
+	tests.Assert(t, 8<<10, c.keys.index.BlockSize())
+
+	// Compacted files keep block size even if it's not configured.
+	c.Close()
+	c, _ = OpenCollection("test", "./test")
+	tests.Assert(t, nil, c.Compact())
+	c.Close()
+
+	c, _ = OpenCollection("test", "./test")
+	tests.Assert(t, 8<<10, c.keys.index.BlockSize())
+
+	val, _ := c.Get([]byte("foo"))
+	tests.Assert(t, "Hello", string(val))
+}
+
+func TestCollectionSwapRollback(t *testing.T) {
+	c, _ := OpenCollection("test", "./test")
+	defer os.RemoveAll("./test")
+
+	c.Set([]byte("foo"), []byte("Hello"))
+
+	// Nothing to swap with, old files are moved back.
+	tests.Assert(t, true, c.Swap("./test.missing") != nil)
+
+	val, _ := c.Get([]byte("foo"))
+	tests.Assert(t, "Hello", string(val))
+
+	_, err := c.Set([]byte("bar"), []byte("World"))
+	tests.Assert(t, nil, err)
+}
+
+func TestOpenCollectionError(t *testing.T) {
+	defer os.RemoveAll("./test")
+
+	os.MkdirAll("./test", 0755)
+	os.WriteFile("./test/"+FormatFile, []byte("broken"), 0644)
+
+	_, err := OpenCollection("test", "./test")
+	tests.Assert(t, true, err != nil)
+}
+
+func TestCollectionOverwriteDelete(t *testing.T) {
+	c, _ := OpenCollection("test", "./test")
+	defer os.RemoveAll("./test")
+
+	c.Set([]byte("key"), []byte("foo"))
+	c.Set([]byte("key"), []byte("bar"))
+
+	val, _ := c.Get([]byte("key"))
+	tests.Assert(t, "bar", string(val))
+
+	tests.Assert(t, nil, c.Delete([]byte("key")))
+
+	_, err := c.Get([]byte("key"))
+	tests.Assert(t, ErrNotFound, err)
+}
+
+// Clock which moves only when told to.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func TestCollectionTTL(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+
+	c, _ := OpenCollection("test", "./test", WithClock(clock.Now))
+	defer os.RemoveAll("./test")
+
+	c.SetWithTTL([]byte("short"), []byte("foo"), time.Millisecond)
+	c.SetWithTTL([]byte("long"), []byte("bar"), time.Hour)
+	c.Set([]byte("forever"), []byte("baz"))
+
+	val, _ := c.Get([]byte("short"))
+	tests.Assert(t, "foo", string(val))
+
+	clock.Add(time.Second)
+
+	_, err := c.Get([]byte("short"))
+	tests.Assert(t, ErrNotFound, err)
+
+	val, _ = c.Get([]byte("long"))
+	tests.Assert(t, "bar", string(val))
+
+	n, _ := c.Reap()
+	tests.Assert(t, 1, n)
+
+	// Nothing left to reap.
+	n, _ = c.Reap()
+	tests.Assert(t, 0, n)
+
+	// Expiration must survive compaction.
+	c.Compact()
+	expired, _ := c.keys.Expired()
+	tests.Assert(t, 0, len(expired))
+
+	val, _ = c.Get([]byte("long"))
+	tests.Assert(t, "bar", string(val))
+
+	val, _ = c.Get([]byte("forever"))
+	tests.Assert(t, "baz", string(val))
+
+	clock.Add(2 * time.Hour)
+
+	n, _ = c.Reap()
+	tests.Assert(t, 1, n)
+}
+
+func TestCollectionReaperErrors(t *testing.T) {
+	errs := make(chan error, 1)
+	onError := func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+
+	c, _ := OpenCollection("test", "./test", WithErrorHandler(onError))
+	defer os.RemoveAll("./test")
+
+	c.Set([]byte("key"), []byte("foo"))
+
+	// Reaper can't read corrupted records.
+	f, _ := os.OpenFile("./test/keys/data/1/1.bin", os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{0xff, 0xff, 0xff})
+	f.Close()
+
+	stop := c.StartReaper(time.Millisecond)
+	defer stop()
+
+	select {
+	case err := <-errs:
+		tests.Assert(t, true, strings.Contains(err.Error(), "reaper"))
+	case <-time.After(5 * time.Second):
+		t.Fatal("reaper didn't report error")
+	}
+}
+
+func TestCollectionCompareAndSwap(t *testing.T) {
+	c, _ := OpenCollection("test", "./test")
+	defer os.RemoveAll("./test")
+
+	ok, _ := c.CompareAndSwap([]byte("key"), nil, []byte("foo"))
+	tests.Assert(t, false, ok)
+
+	ok, _ = c.SetIfAbsent([]byte("key"), []byte("foo"))
+	tests.Assert(t, true, ok)
+
+	ok, _ = c.SetIfAbsent([]byte("key"), []byte("bar"))
+	tests.Assert(t, false, ok)
+
+	ok, _ = c.CompareAndSwap([]byte("key"), []byte("bar"), []byte("baz"))
+	tests.Assert(t, false, ok)
+
+	ok, _ = c.CompareAndSwap([]byte("key"), []byte("foo"), []byte("baz"))
+	tests.Assert(t, true, ok)
+
+	val, version, _ := c.GetWithVersion([]byte("key"))
+	tests.Assert(t, "baz", string(val))
+	tests.Assert(t, 2, version)
+
+	ok, _ = c.SetIfVersion([]byte("key"), []byte("qux"), 1)
+	tests.Assert(t, false, ok)
+
+	ok, _ = c.SetIfVersion([]byte("key"), []byte("qux"), 2)
+	tests.Assert(t, true, ok)
+
+	// Versions must survive compaction.
+	c.Compact()
+	_, version, _ = c.GetWithVersion([]byte("key"))
+	tests.Assert(t, 3, version)
+}
+
+func TestCollectionDeleteVersion(t *testing.T) {
+	c, _ := OpenCollection("test", "./test")
+	defer os.RemoveAll("./test")
+
+	key := []byte("key")
+	c.Set(key, []byte("foo"))
+	_, stale, _ := c.GetWithVersion(key)
+
+	// Key is deleted and created again, stale version must not match.
+	tests.Assert(t, nil, c.Delete(key))
+	c.Set(key, []byte("bar"))
+
+	ok, _ := c.SetIfVersion(key, []byte("baz"), stale)
+	tests.Assert(t, false, ok)
+
+	_, version, _ := c.GetWithVersion(key)
+	tests.Assert(t, 2, version)
+
+	// Tombstones must survive compaction.
+	c.Delete(key)
+	tests.Assert(t, nil, c.Compact())
+
+	_, err := c.Get(key)
+	tests.Assert(t, ErrNotFound, err)
+	tests.Assert(t, ErrNotFound, c.Delete(key))
+
+	c.Set(key, []byte("qux"))
+	_, version, _ = c.GetWithVersion(key)
+	tests.Assert(t, 3, version)
+}
+
+func TestCollectionConcurrentCounter(t *testing.T) {
+	c, _ := OpenCollection("test", "./test")
+	defer os.RemoveAll("./test")
+
+	key := []byte("counter")
+	c.Set(key, []byte{0})
+
+	tests.RunConcurrently(10, func() {
+		for i := 0; i < 20; {
+			val, version, _ := c.GetWithVersion(key)
+
+			ok, _ := c.SetIfVersion(key, []byte{val[0] + 1}, version)
+			if ok {
+				i++
+			}
+		}
+	})
+
+	val, _ := c.Get(key)
+	tests.Assert(t, 200, int(val[0]))
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// Compression algorithm used for record values.
+type Compression uint8
+
+const (
+	NoCompression Compression = iota
+	Flate
+	Zlib
+	Gzip
+)
+
+// Compress data with given algorithm.
+func compress(c Compression, data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	var w io.WriteCloser
+	var err error
+
+	switch c {
+	case NoCompression:
+		return data, nil
+	case Flate:
+		w, err = flate.NewWriter(buf, flate.DefaultCompression)
+	case Zlib:
+		w = zlib.NewWriter(buf)
+	case Gzip:
+		w = gzip.NewWriter(buf)
+	default:
+		return nil, fmt.Errorf("unknown compression: %d", c)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decompress data compressed with given algorithm.
+func decompress(c Compression, data []byte) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+
+	src := bytes.NewReader(data)
+
+	switch c {
+	case NoCompression:
+		return data, nil
+	case Flate:
+		r = flate.NewReader(src)
+	case Zlib:
+		r, err = zlib.NewReader(src)
+	case Gzip:
+		r, err = gzip.NewReader(src)
+	default:
+		return nil, fmt.Errorf("unknown compression: %d", c)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,20 @@
+package db
+
+import (
+	"bucketdb/tests"
+	"bytes"
+	"testing"
+)
+
+func TestCompressDecompress(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World "), 100)
+
+	for _, c := range []Compression{NoCompression, Flate, Zlib, Gzip} {
+		raw, err := compress(c, data)
+		tests.Assert(t, nil, err)
+
+		res, err := decompress(c, raw)
+		tests.Assert(t, nil, err)
+		tests.AssertEqual(t, data, res)
+	}
+}
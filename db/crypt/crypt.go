@@ -0,0 +1,159 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	NonceSize = 12
+	TagSize   = 16
+	KeyIDSize = 4
+
+	// Number of bytes added to each sealed message.
+	Overhead = KeyIDSize + NonceSize + TagSize
+)
+
+var ErrShortMessage = errors.New("sealed message is too short")
+
+// KeyProvider supplies encryption keys. Each key has an id which is
+// stored next to encrypted data, so keys can be rotated: new data is
+// encrypted with the current key, old data is decrypted with the key
+// it was encrypted with.
+type KeyProvider interface {
+	// Id and key used to encrypt new data.
+	Current() (uint32, []byte, error)
+
+	// Key with given id.
+	Key(id uint32) ([]byte, error)
+}
+
+// In-memory key provider.
+type KeyRing struct {
+	mu      sync.RWMutex
+	keys    map[uint32][]byte
+	current uint32
+}
+
+// Create key ring with initial key. Key must be 16, 24 or 32 bytes long.
+func NewKeyRing(id uint32, key []byte) *KeyRing {
+	return &KeyRing{keys: map[uint32][]byte{id: key}, current: id}
+}
+
+// Add new key and use it for all new data.
+func (r *KeyRing) Rotate(id uint32, key []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.keys[id] = key
+	r.current = id
+}
+
+func (r *KeyRing) Current() (uint32, []byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.current, r.keys[r.current], nil
+}
+
+func (r *KeyRing) Key(id uint32) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	key, ok := r.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id: %d", id)
+	}
+
+	return key, nil
+}
+
+// AES-GCM cipher.
+//
+// Sealed message layout:
+//
+//	key id | nonce | ciphertext | tag
+type Cipher struct {
+	keys KeyProvider
+
+	// Initialized AEADs per key id.
+	mu    sync.Mutex
+	aeads map[uint32]cipher.AEAD
+}
+
+func New(keys KeyProvider) *Cipher {
+	return &Cipher{keys: keys, aeads: map[uint32]cipher.AEAD{}}
+}
+
+// Encrypt data with the current key.
+func (c *Cipher) Seal(data []byte) ([]byte, error) {
+	id, key, err := c.keys.Current()
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := c.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, KeyIDSize+NonceSize, Overhead+len(data))
+	binary.BigEndian.PutUint32(out, id)
+
+	nonce := out[KeyIDSize:]
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(out, nonce, data, out[:KeyIDSize]), nil
+}
+
+// Decrypt data sealed by Seal.
+func (c *Cipher) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < Overhead {
+		return nil, ErrShortMessage
+	}
+
+	id := binary.BigEndian.Uint32(sealed)
+
+	key, err := c.keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := c.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := sealed[KeyIDSize : KeyIDSize+NonceSize]
+	return aead.Open(nil, nonce, sealed[KeyIDSize+NonceSize:], sealed[:KeyIDSize])
+}
+
+func (c *Cipher) aead(id uint32, key []byte) (cipher.AEAD, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if aead, ok := c.aeads[id]; ok {
+		return aead, nil
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	c.aeads[id] = aead
+	return aead, nil
+}
@@ -0,0 +1,42 @@
+package crypt
+
+import (
+	"bucketdb/tests"
+	"bytes"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	c := New(NewKeyRing(1, bytes.Repeat([]byte{1}, 32)))
+
+	data := []byte("Hello World")
+	sealed, _ := c.Seal(data)
+
+	tests.Assert(t, len(data)+Overhead, len(sealed))
+
+	res, err := c.Open(sealed)
+	tests.Assert(t, nil, err)
+	tests.AssertEqual(t, data, res)
+
+	// Tampered message.
+	sealed[len(sealed)-1] ^= 1
+	_, err = c.Open(sealed)
+	tests.Assert(t, true, err != nil)
+}
+
+func TestRotate(t *testing.T) {
+	ring := NewKeyRing(1, bytes.Repeat([]byte{1}, 32))
+	c := New(ring)
+
+	old, _ := c.Seal([]byte("old"))
+
+	ring.Rotate(2, bytes.Repeat([]byte{2}, 32))
+	new, _ := c.Seal([]byte("new"))
+
+	// Both messages must be readable.
+	res, _ := c.Open(old)
+	tests.Assert(t, "old", string(res))
+
+	res, _ = c.Open(new)
+	tests.Assert(t, "new", string(res))
+}
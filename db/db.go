@@ -1,7 +1,12 @@
 package db
 
 import (
+	"bucketdb/db/crypt"
+	"bucketdb/db/wal"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 )
 
 const (
@@ -14,10 +19,20 @@ type DB struct {
 	root string
 
 	internals *DB
+
+	// Options used for all collections.
+	opts []Option
+
+	// Log for transactions spanning multiple collections.
+	wal *wal.Wal
+
+	// Opened collections, each collection is opened only once.
+	mu          sync.Mutex
+	collections map[string]*Collection
 }
 
-// Open database.
-func Open(path string) (*DB, error) {
+// Open database. Options are applied to all collections.
+func Open(path string, opts ...Option) (*DB, error) {
 	// Create main database and internal one.
 	internal := path + "/internal"
 	err := os.MkdirAll(internal, 0755)
@@ -25,11 +40,120 @@ func Open(path string) (*DB, error) {
 		return nil, err
 	}
 
-	internals := &DB{root: internal}
-	return &DB{root: path, internals: internals}, nil
+	internals := &DB{root: internal, collections: map[string]*Collection{}}
+	db := &DB{root: path, internals: internals, collections: map[string]*Collection{}, opts: opts}
+
+	err = os.MkdirAll(filepath.Join(path, "wal"), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	o := newOptions(opts...)
+
+	db.wal, err = wal.Open(filepath.Join(path, "wal", "db.wal"), o.WalSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.Keys != nil {
+		db.wal.Cipher = crypt.New(o.Keys)
+	}
+
+	// Apply or discard transactions interrupted by crash.
+	err = db.recover()
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Database root directory.
+func (db *DB) Root() string {
+	return db.root
+}
+
+// Open collection with given name. Create one if it doesn't exist.
+// Options are used only when collection is opened for the first time,
+// they are applied after database options.
+func (db *DB) Collection(name string, opts ...Option) (*Collection, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c, ok := db.collections[name]
+	if !ok {
+		var err error
+
+		opts = append(append([]Option{}, db.opts...), opts...)
+		c, err = OpenCollection(name, filepath.Join(db.root, CollectionsPath, name), opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		db.collections[name] = c
+	}
+
+	return c, nil
+}
+
+// List names of all collections stored in database.
+func (db *DB) Collections() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(db.root, CollectionsPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, e := range entries {
+		// Skip temporary directories left by migrations and compactions.
+		name := e.Name()
+		if !e.IsDir() || isTemp(name) {
+			continue
+		}
+
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// Check if directory is a temporary one, created when collection is rewritten.
+func isTemp(name string) bool {
+	for _, ext := range []string{".migrate", ".compact", ".old"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Close database and all opened collections.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for name, c := range db.collections {
+		err := c.Close()
+		if err != nil {
+			return err
+		}
+		delete(db.collections, name)
+	}
+
+	return db.wal.Close()
 }
 
 // Delete the entire database.
 func (db *DB) Delete() error {
+	err := db.Close()
+	if err != nil {
+		return err
+	}
+
 	return os.RemoveAll(db.root)
 }
@@ -1,10 +1,13 @@
 package db
 
 import (
+	"bucketdb/db/crypt"
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // Manage files and subdirectories.
@@ -16,10 +19,26 @@ type Directory struct {
 	// Get last file (with highest id) from directory.
 	// In most cases this will be the file we are currently writing to.
 	Last *File
+
+	// Opened files, so we don't open the same file over and over again.
+	mu    sync.Mutex
+	files map[int]*File
+
+	// Encrypts file blocks, nil if encryption is disabled.
+	cipher *crypt.Cipher
+
+	// Files use blocks without page header, see Format.
+	legacy bool
+
+	// Blocks of files may have no checksum, see Format.
+	unsealed bool
+
+	// Block size of files, 0 for default.
+	blockSize int64
 }
 
 func Dir(root string, perDir int, extension string) *Directory {
-	d := &Directory{Root: root, PerDir: perDir, Ext: extension}
+	d := &Directory{Root: root, PerDir: perDir, Ext: extension, files: map[int]*File{}}
 	id := d.Max()
 
 	// Dir is empty.
@@ -38,6 +57,13 @@ func Dir(root string, perDir int, extension string) *Directory {
 
 // Get file from directory. Create it if it doesn't already exist.
 func (d *Directory) Get(id int) (*File, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if f, ok := d.files[id]; ok {
+		return f, nil
+	}
+
 	// Get subdir based on id using ceil technique.
 	subdir := (d.PerDir + id - 1) / d.PerDir
 
@@ -56,9 +82,70 @@ func (d *Directory) Get(id int) (*File, error) {
 	}
 
 	f.ID = id
+	f.cipher = d.cipher
+	f.legacy = d.legacy
+	f.unsealed = d.unsealed
+	if d.blockSize != 0 {
+		f.blockSize = d.blockSize
+	}
+	d.files[id] = f
+
 	return f, nil
 }
 
+// Encrypt blocks of all files in directory.
+func (d *Directory) Encrypt(c *crypt.Cipher) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.cipher = c
+	for _, f := range d.files {
+		f.cipher = c
+	}
+}
+
+// Set format version of files in directory. Blocks have page header
+// since format 5, older files are read with the old block layout.
+// Blocks written before format 7 may have no checksum.
+func (d *Directory) Format(version int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.legacy = version < 5
+	d.unsealed = version < 7
+	for _, f := range d.files {
+		f.legacy = d.legacy
+		f.unsealed = d.unsealed
+	}
+}
+
+// Set block size of files in directory.
+func (d *Directory) BlockSize(size int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.blockSize = size
+	for _, f := range d.files {
+		f.blockSize = size
+	}
+}
+
+// Close all opened files. Files are closed even if some of them fail,
+// all errors are returned.
+func (d *Directory) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var errs []error
+
+	for id, f := range d.files {
+		errs = append(errs, f.Close())
+		delete(d.files, id)
+	}
+
+	return errors.Join(errs...)
+}
+
 // Search in subdirectories and find max file id.
 func (d *Directory) Max() int {
 	max := 0
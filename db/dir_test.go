@@ -35,3 +35,16 @@ func TestDirMax(t *testing.T) {
 
 	tests.Assert(t, 13, d.Max())
 }
+
+func TestDirClose(t *testing.T) {
+	d := Dir("./test", 3, "idx")
+	defer os.RemoveAll("./test")
+
+	f1, _ := d.Get(1)
+	d.Get(2)
+
+	// Already closed file fails, the other one is still closed.
+	f1.Close()
+	tests.Assert(t, true, d.Close() != nil)
+	tests.Assert(t, 0, len(d.files))
+}
@@ -1,6 +1,9 @@
 package db
 
 import (
+	"bucketdb/db/crypt"
+	"bucketdb/db/page"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -10,10 +13,22 @@ import (
 
 var ErrFull = errors.New("index is full")
 
+// Size of file blocks, unless it's configured with WithBlockSize.
+const DefaultBlockSize = 4096
+
 type File struct {
 	ID        int
 	file      *os.File
 	blockSize int64
+
+	// Encrypts blocks, nil if encryption is disabled.
+	cipher *crypt.Cipher
+
+	// Blocks don't have page header (format < 5).
+	legacy bool
+
+	// Blocks may have no checksum (format < 7).
+	unsealed bool
 }
 
 // Offset keeps information about the location of the data.
@@ -22,6 +37,22 @@ type Offset struct {
 	Start  uint32
 	Size   uint32
 	Hash   [8]byte
+
+	// Incremented each time the key is set, starting from 1.
+	// Not stored in indexes older than format 3.
+	Version uint32
+}
+
+// Check if both offsets point to the same data.
+func (o *Offset) Same(other *Offset) bool {
+	return o.FileID == other.FileID && o.Start == other.Start
+}
+
+// Check if offset is a tombstone of deleted key. Tombstones point to
+// no data, they only keep version of the key in index, so it doesn't
+// start from 1 again when key is recreated.
+func (o *Offset) Deleted() bool {
+	return o.Size == 0
 }
 
 // Open path. Create one if it doesn't exists.
@@ -44,10 +75,15 @@ func OpenPath(path string, flag int) (*File, error) {
 func OpenFile(path string, flag int) (*File, error) {
 	file, err := os.OpenFile(path, flag, 0644)
 	if err != nil {
-		return nil, nil
+		return nil, err
 	}
 
-	return &File{file: file, blockSize: 4096}, nil
+	return &File{file: file, blockSize: DefaultBlockSize}, nil
+}
+
+// Close file.
+func (f *File) Close() error {
+	return f.file.Close()
 }
 
 // Resize file to given size.
@@ -77,8 +113,13 @@ func (f *File) BlockCount() int64 {
 
 // Write data to file.
 func (f *File) Write(data []byte) (*Offset, error) {
+	// Always append to the end of the file, file could be reopened
+	// and its offset would point to the beginning.
 	// TODO: If this will be too expensive, we will track our own offset.
-	start, _ := f.file.Seek(0, io.SeekCurrent)
+	start, err := f.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
 
 	n, err := f.file.Write(data)
 	if err != nil {
@@ -121,12 +162,43 @@ func (f *File) WriteBlock(num int64, data []byte) (int, error) {
 	block.Write(data)
 
 	// Write entire block back to the file.
-	n, err := f.file.WriteAt(block.data, block.offset)
-	return n, err
+	return f.SaveBlock(block)
+}
+
+// Write entire block back to the file. Pages are checksummed before
+// they are encrypted.
+func (f *File) SaveBlock(block *Block) (int, error) {
+	raw := block.data
+
+	if block.header != nil {
+		block.header.SetSize(int(f.blockSize))
+
+		err := page.Seal(block.data)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if f.cipher != nil {
+		var err error
+
+		raw, err = f.cipher.Seal(block.data)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return f.file.WriteAt(raw, block.offset)
 }
 
 // Read data from given block.
 func (f *File) ReadBlock(num int64) (*Block, error) {
+	return f.readBlock(num, true)
+}
+
+// Read block, optionally without checking its checksum, ex: to salvage
+// what is left of corrupted one.
+func (f *File) readBlock(num int64, verify bool) (*Block, error) {
 	// Get block offset.
 	offset := num * f.blockSize
 
@@ -134,8 +206,78 @@ func (f *File) ReadBlock(num int64) (*Block, error) {
 	data := make([]byte, f.blockSize)
 	_, err := f.file.ReadAt(data, offset)
 
-	b := NewBlock(data, int32(f.blockSize))
+	// Torn encrypted block fails authentication.
+	if err == nil && f.cipher != nil {
+		data, err = f.decryptBlock(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: block %d of file %d: %w", ErrCorruptBlock, num, f.ID, err)
+		}
+	}
+
+	b := NewBlock(data, int32(len(data)))
+
+	// Blocks have page header since format 5.
+	if !f.legacy {
+		perr := f.verify(data)
+		if verify && perr != nil {
+			return nil, fmt.Errorf("%w: block %d of file %d: %w", ErrCorruptBlock, num, f.ID, perr)
+		}
+
+		b, perr = OpenBlock(data)
+		if perr != nil {
+			return nil, perr
+		}
+	}
 	b.offset = offset
 
 	return b, err
 }
+
+// Verify block checksum, blocks of old files may not have one.
+func (f *File) verify(data []byte) error {
+	if f.unsealed {
+		return page.VerifyUnsealed(data)
+	}
+
+	return page.Verify(data)
+}
+
+// Find block size stored in the header of the first block. Block is
+// read with each supported size until its checksum matches, so it works
+// for encrypted files too. Returns 0 if size isn't stored.
+func (f *File) storedBlockSize() int64 {
+	size := f.blockSize
+	defer func() { f.blockSize = size }()
+
+	for s := int64(page.MinSize); s <= page.MaxSize && s <= f.Size(); s *= 2 {
+		f.blockSize = s
+
+		b, err := f.ReadBlock(0)
+		if err != nil || b.header == nil || b.header.Type == page.Empty {
+			continue
+		}
+
+		if b.header.Shift != 0 && b.header.Size() == int(s) {
+			return s
+		}
+	}
+
+	return 0
+}
+
+// Zero given block, it's read back as a block which was never written.
+func (f *File) clearBlock(num int64) error {
+	_, err := f.file.WriteAt(make([]byte, f.blockSize), num*f.blockSize)
+	return err
+}
+
+// Decrypt block data. Encryption overhead is taken from the block,
+// so decrypted block is smaller than the one stored on disk.
+func (f *File) decryptBlock(raw []byte) ([]byte, error) {
+	// Block was never written.
+	if bytes.Count(raw, []byte{0}) == len(raw) {
+		return make([]byte, len(raw)-crypt.Overhead), nil
+	}
+
+	return f.cipher.Open(raw)
+}
@@ -1,7 +1,9 @@
 package db
 
 import (
+	"bucketdb/db/page"
 	"bucketdb/tests"
+	"errors"
 	"os"
 	"testing"
 )
@@ -14,5 +16,60 @@ func TestFileWriteReadBlock(t *testing.T) {
 	f.WriteBlock(10, []byte("Hello database"))
 
 	b, _ := f.ReadBlock(10)
-	tests.Assert(t, string([]byte("Hello database")), string(b.data[:14]))
+	tests.Assert(t, string([]byte("Hello database")), string(b.payload()[:14]))
+}
+
+func TestFileReadBlockLegacy(t *testing.T) {
+	f, _ := OpenFile(".legacy.idx", os.O_RDWR|os.O_CREATE)
+	defer os.Remove(".legacy.idx")
+
+	f.legacy = true
+	f.Resize(100_000)
+	f.WriteBlock(10, []byte("Hello database"))
+
+	b, _ := f.ReadBlock(10)
+	tests.Assert(t, "Hello database", string(b.data[:14]))
+
+	// Length is in the footer, not in page header.
+	size := uint32(0)
+	b.ReadFooter(ToBytes(&size))
+	tests.Assert(t, 14, size)
+}
+
+func TestFileBlockChecksum(t *testing.T) {
+	f, _ := OpenFile(".checksum.idx", os.O_RDWR|os.O_CREATE)
+	defer os.Remove(".checksum.idx")
+
+	f.Resize(100_000)
+	f.WriteBlock(10, []byte("Hello database"))
+
+	_, err := f.ReadBlock(10)
+	tests.AssertEqual(t, nil, err)
+
+	// Data changed without updating the header.
+	f.file.WriteAt([]byte("J"), 10*f.blockSize+int64(page.HeaderSize))
+
+	_, err = f.ReadBlock(10)
+	tests.Assert(t, true, errors.Is(err, ErrCorruptBlock))
+
+	// Data written to block which was never written, header is lost.
+	f.file.WriteAt([]byte("torn"), 11*f.blockSize+2048)
+
+	_, err = f.ReadBlock(11)
+	tests.Assert(t, true, errors.Is(err, ErrCorruptBlock))
+
+	f.clearBlock(10)
+	_, err = f.ReadBlock(10)
+	tests.AssertEqual(t, nil, err)
+
+	// Checksum zeroed, only files of old formats have such blocks.
+	f.WriteBlock(12, []byte("Hello database"))
+	f.file.WriteAt(make([]byte, 4), 12*f.blockSize+4)
+
+	_, err = f.ReadBlock(12)
+	tests.Assert(t, true, errors.Is(err, ErrCorruptBlock))
+
+	f.unsealed = true
+	_, err = f.ReadBlock(12)
+	tests.AssertEqual(t, nil, err)
 }
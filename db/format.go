@@ -0,0 +1,97 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Current on-disk format version. Bump it every time the layout
+// of data or index files changes, Keys must still be able to read
+// older versions so they can be migrated.
+//
+//	1: bitbox encoded key and value
+//	2: record flags (compression, encryption, expiration)
+//	3: key version in index offsets
+//	4: varint length prefixes in records
+//	5: page header in index blocks
+//	6: tombstones of deleted keys in index
+//	7: checksums in all index blocks
+const FormatVersion = 7
+
+// Formats which only add information to new records (ex: record flags),
+// files of the previous format stay readable. Collections are upgraded
+// to them in place, by rewriting FORMAT file, other formats require
+// migration. Secondary indexes are rebuilt on every upgrade, see
+// CreateIndex.
+var inPlace = map[int]bool{
+	4: true,
+	6: true,
+}
+
+// Check if collection in given format can be upgraded to the current
+// one without rewriting its files.
+func upgradable(version int) bool {
+	if version < 1 || version > FormatVersion {
+		return false
+	}
+
+	for v := version + 1; v <= FormatVersion; v++ {
+		if !inPlace[v] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Name of the file holding the format version of a collection.
+const FormatFile = "FORMAT"
+
+var ErrOutdatedFormat = errors.New("collection format is outdated, migration required")
+
+// Read format version of the collection stored in root.
+//
+// Collections created before we started tracking versions don't
+// have a FORMAT file, we report them as version 0. Empty (new)
+// collections report the current version.
+func ReadFormat(root string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(root, FormatFile))
+
+	if errors.Is(err, os.ErrNotExist) {
+		_, err := os.Stat(filepath.Join(root, "keys"))
+		if errors.Is(err, os.ErrNotExist) {
+			return FormatVersion, nil
+		}
+
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// Write format version for the collection stored in root.
+func WriteFormat(root string, version int) error {
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return err
+	}
+
+	// Write to temporary file first and rename it, so we never
+	// end up with half written version.
+	path := filepath.Join(root, FormatFile)
+	tmp := path + ".tmp"
+
+	err = os.WriteFile(tmp, []byte(strconv.Itoa(version)), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,40 @@
+package db
+
+import (
+	"bucketdb/tests"
+	"os"
+	"testing"
+)
+
+func TestReadWriteFormat(t *testing.T) {
+	defer os.RemoveAll("./test")
+
+	// New collection.
+	v, _ := ReadFormat("./test")
+	tests.Assert(t, FormatVersion, v)
+
+	// Collection without FORMAT file.
+	os.MkdirAll("./test/keys", 0755)
+	v, _ = ReadFormat("./test")
+	tests.Assert(t, 0, v)
+
+	WriteFormat("./test", 7)
+	v, _ = ReadFormat("./test")
+	tests.Assert(t, 7, v)
+}
+
+func TestUpgradable(t *testing.T) {
+	tests.Assert(t, true, upgradable(FormatVersion))
+	tests.Assert(t, false, upgradable(0))
+	tests.Assert(t, false, upgradable(FormatVersion+1))
+
+	// Varint records are flagged, but format 5 changed index blocks.
+	tests.Assert(t, true, inPlace[4])
+	tests.Assert(t, false, upgradable(3))
+
+	// Old indexes simply don't have tombstones.
+	tests.Assert(t, true, inPlace[6])
+
+	// Blocks without checksum must be rewritten.
+	tests.Assert(t, false, upgradable(6))
+}
@@ -1,12 +1,17 @@
 package db
 
 import (
+	"bucketdb/db/page"
 	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/fnv"
 	"unsafe"
 )
 
+var ErrNotFound = errors.New("key not found")
+
 type Index struct {
 	files       *Directory
 	keysPerFile int64
@@ -14,25 +19,77 @@ type Index struct {
 }
 
 // Open index for given directory.
-func OpenIndex(files *Directory, keysPerFile int64) (*Index, error) {
+func OpenIndex(files *Directory, keysPerFile int64, opts ...Option) (*Index, error) {
+	o := newOptions(opts...)
+	files.Format(o.Format)
+
 	i := &Index{
 		files:       files,
 		keysPerFile: keysPerFile,
 		IndexSize:   int8(unsafe.Sizeof(Offset{})),
 	}
 
+	// Offsets don't have version before format 3.
+	if o.Format < 3 {
+		i.IndexSize -= int8(unsafe.Sizeof(Offset{}.Version))
+	}
+
+	err := i.useBlockSize(o)
+	if err != nil {
+		return nil, err
+	}
+
 	i.Prealloc(keysPerFile)
 	return i, nil
 }
 
+// Use block size stored in index file, configured one is used only for
+// new files. Files created before block sizes were stored have default
+// size.
+func (i *Index) useBlockSize(o *Options) error {
+	err := page.CheckSize(o.BlockSize)
+	if err != nil {
+		return fmt.Errorf("%w: %d", err, o.BlockSize)
+	}
+
+	if o.Format < 5 {
+		return nil
+	}
+
+	f := i.files.Last
+	size := int64(o.BlockSize)
+
+	if f.Size() > 0 {
+		size = f.storedBlockSize()
+		if size == 0 {
+			size = DefaultBlockSize
+		}
+	}
+
+	i.files.BlockSize(size)
+	return nil
+}
+
+// Size of index blocks.
+func (i *Index) BlockSize() int64 {
+	return i.files.Last.blockSize
+}
+
 // Preallocate space for max number of keys per file.
 func (i *Index) Prealloc(num int64) (int64, error) {
 	f := i.files.Last
+	created := f.Size() == 0
 
 	// Calculate required space for all keys.
 	size := num * int64(i.IndexSize)
 	size = (size * 140) / 100 // +40% for collisions
 
+	// New files end on block boundary. Existing ones keep their size,
+	// changing the number of blocks would move keys to other blocks.
+	if created {
+		size = (size + f.blockSize - 1) / f.blockSize * f.blockSize
+	}
+
 	// Resize if file is smaller than expected.
 	if f.Size() < size {
 		err := f.Resize(size)
@@ -41,64 +98,201 @@ func (i *Index) Prealloc(num int64) (int64, error) {
 		}
 	}
 
+	// Store block size in the first block, see File.storedBlockSize.
+	if created && !f.legacy {
+		b, err := f.ReadBlock(0)
+		if err != nil {
+			return 0, err
+		}
+
+		b.use(page.Raw)
+
+		_, err = f.SaveBlock(b)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	return size, nil
 }
 
 // Set index for the given kv and stores it in the index file.
+// If key is already indexed, its offset is overwritten.
 func (i *Index) Set(key []byte, off *Offset) error {
-	f := i.files.Last
-	h := Hash(key)
+	return i.set(Hash(key), off)
+}
 
+// Set index for the given key hash.
+func (i *Index) set(h uint64, off *Offset) error {
+	f := i.files.Last
 	off.Hash = [8]byte(ToBytes(&h))
 
+	// Key already exists, overwrite its offset.
+	b, pos, err := i.find(h)
+	if err == nil {
+		b.WriteAt(i.bytes(off), pos)
+		_, err = f.SaveBlock(b)
+		return err
+	}
+
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
 	// Get block number for key.
-	n := int64(h % uint64(f.BlockCount()))
+	n := i.block(h)
 
 	// If block is full, write to next one.
 	for j := 0; j < 2; j++ {
-		_, err := f.WriteBlock(n, ToBytes(off))
+		_, err := f.WriteBlock(n, i.bytes(off))
 
 		// Block is full, write to next one.
 		if errors.Is(err, ErrFull) {
-			n += 1
+			n = (n + 1) % f.BlockCount()
 			continue
 		}
-		return nil
+		return err
 	}
 
-	return nil
+	return ErrFull
 }
 
 // Get index.
 func (i *Index) Get(key []byte) (*Offset, error) {
+	b, pos, err := i.find(Hash(key))
+	if err != nil {
+		return new(Offset), err
+	}
+
+	off := &Offset{}
+	copy(i.bytes(off), b.payload()[pos:])
+
+	return off, nil
+}
+
+// Get tombstones of all deleted keys, see Offset.Deleted.
+func (i *Index) Tombstones() ([]*Offset, error) {
+	f := i.files.Last
+	size := int(i.IndexSize)
+	offsets := []*Offset{}
+
+	for n := int64(0); n < f.BlockCount(); n++ {
+		b, err := f.ReadBlock(n)
+		if err != nil {
+			return nil, err
+		}
+
+		// Space after the last offset is zeroed, so stop at block length.
+		for pos := 0; pos+size <= int(b.footer.Len); pos += size {
+			off := &Offset{}
+			copy(i.bytes(off), b.payload()[pos:])
+
+			if off.Deleted() {
+				offsets = append(offsets, off)
+			}
+		}
+	}
+
+	return offsets, nil
+}
+
+// Find blocks of index file which fail checksum verification.
+func (i *Index) Corrupted() ([]int64, error) {
+	f := i.files.Last
+	blocks := []int64{}
+
+	for n := int64(0); n < f.BlockCount(); n++ {
+		_, err := f.ReadBlock(n)
+
+		if errors.Is(err, ErrCorruptBlock) {
+			blocks = append(blocks, n)
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return blocks, nil
+}
+
+// Get the highest key version stored in index. What is left of
+// corrupted blocks is read too, offsets count only if their hash
+// belongs to the block or the previous one, like in find.
+func (i *Index) MaxVersion() (uint32, error) {
+	f := i.files.Last
+	size := int(i.IndexSize)
+	max := uint32(0)
+
+	for n := int64(0); n < f.BlockCount(); n++ {
+		b, err := f.readBlock(n, false)
+
+		// Header or encryption of corrupted block is broken, nothing to
+		// salvage.
+		if errors.Is(err, ErrBlockLength) || errors.Is(err, ErrCorruptBlock) {
+			continue
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		payload := b.payload()
+		prev := (n + f.BlockCount() - 1) % f.BlockCount()
+
+		for pos := 0; pos+size <= int(b.footer.Len) && pos+size <= len(payload); pos += size {
+			off := &Offset{}
+			copy(i.bytes(off), payload[pos:])
+
+			h := i.block(binary.NativeEndian.Uint64(off.Hash[:]))
+			if (h == n || h == prev) && off.Version > max {
+				max = off.Version
+			}
+		}
+	}
+
+	return max, nil
+}
+
+// Find block and position of the offset with given hash.
+func (i *Index) find(h uint64) (*Block, int, error) {
 	f := i.files.Last
-	h := Hash(key)
 
 	// Get block number for key.
-	n := int64(h % uint64(f.BlockCount()))
+	n := i.block(h)
 	off := &Offset{}
 
 	// Find index key in block. If not found we will search in next block.
-	// What if not found ? Undecided yet 🫣
 	for j := 0; j < 2; j++ {
 		// Read block.
 		b, err := f.ReadBlock(n)
 		if err != nil {
-			return new(Offset), err
+			return nil, 0, err
 		}
 
 		// Read all offsets from block and compare them to the hash we are looking for.
-		for b.Read(ToBytes(off)) {
+		for b.Read(i.bytes(off)) {
 			if bytes.Equal(off.Hash[:], ToBytes(&h)) {
-				return off, nil
+				return b, b.ReadOffset - int(i.IndexSize), nil
 			}
 		}
 
 		// We didn't find anything, increment to next block.
-		n += 1
+		n = (n + 1) % f.BlockCount()
 	}
 
-	return new(Offset), nil
+	return nil, 0, ErrNotFound
+}
+
+// Offset bytes stored in index.
+func (i *Index) bytes(off *Offset) []byte {
+	return ToBytes(off)[:i.IndexSize]
+}
+
+// Get block number for hash.
+func (i *Index) block(h uint64) int64 {
+	return int64(h % uint64(i.files.Last.BlockCount()))
 }
 
 // Compute hash for given key.
@@ -1,7 +1,11 @@
 package db
 
 import (
+	"bucketdb/db/crypt"
+	"bucketdb/db/page"
 	"bucketdb/tests"
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -17,7 +21,7 @@ func TestIndexPrealloc(t *testing.T) {
 	i, _ := OpenIndex(Dir("./test", 10, "bin"), *num)
 	defer os.RemoveAll("./test")
 
-	prealloc := int64(2800000) // keys + collisions
+	prealloc := int64(3362816) // keys + collisions, aligned to blocks
 	tests.AssertEqual(t, prealloc, i.files.Last.Size())
 }
 
@@ -42,3 +46,73 @@ func TestIndexSetGet(t *testing.T) {
 		tests.Assert(t, i, int(off.Start))
 	}
 }
+
+func TestIndexBlockSize(t *testing.T) {
+	defer os.RemoveAll("./test")
+
+	ring := crypt.NewKeyRing(1, bytes.Repeat([]byte{1}, 32))
+
+	for _, encrypt := range []bool{false, true} {
+		os.RemoveAll("./test")
+
+		open := func(opts ...Option) (*Index, error) {
+			dir := Dir("./test", 10, "bin")
+			if encrypt {
+				dir.Encrypt(crypt.New(ring))
+			}
+
+			return OpenIndex(dir, 1000, opts...)
+		}
+
+		idx, err := open(WithBlockSize(16 << 10))
+		tests.AssertEqual(t, nil, err)
+		tests.Assert(t, 16<<10, idx.BlockSize())
+		tests.Assert(t, 0, idx.files.Last.Size()%(16<<10))
+
+		for i := 0; i < 1000; i++ {
+			idx.Set([]byte(fmt.Sprintf("key_%d", i)), &Offset{Start: uint32(i)})
+		}
+		idx.files.Close()
+
+		// Size is read from the file, option applies only to new files.
+		idx, _ = open(WithBlockSize(64 << 10))
+		tests.Assert(t, 16<<10, idx.BlockSize())
+
+		for i := 0; i < 1000; i++ {
+			off, err := idx.Get([]byte(fmt.Sprintf("key_%d", i)))
+			tests.AssertEqual(t, nil, err)
+			tests.Assert(t, i, int(off.Start))
+		}
+		idx.files.Close()
+	}
+
+	for _, size := range []int{0, 2048, 5000, 128 << 10} {
+		_, err := OpenIndex(Dir("./test/invalid", 10, "bin"), 1000, WithBlockSize(size))
+		tests.Assert(t, true, errors.Is(err, page.ErrSize))
+	}
+}
+
+// Compare block sizes for random keys. Bigger blocks overflow less often
+// but each lookup reads and checksums more data.
+func BenchmarkIndexBlockSize(b *testing.B) {
+	for size := page.MinSize; size <= page.MaxSize; size *= 2 {
+		b.Run(fmt.Sprintf("%dK", size>>10), func(b *testing.B) {
+			defer os.RemoveAll("./test")
+
+			idx, _ := OpenIndex(Dir("./test", 10, "bin"), 20_000, WithBlockSize(size))
+			defer idx.files.Close()
+
+			keys := make([][]byte, 10_000)
+			for i := range keys {
+				keys[i] = []byte(fmt.Sprintf("key_%d", i))
+				idx.Set(keys[i], &Offset{Start: uint32(i)})
+			}
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				idx.Get(keys[i%len(keys)])
+			}
+		})
+	}
+}
@@ -1,31 +1,100 @@
 package db
 
 import (
+	"bucketdb/db/crypt"
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
 )
 
 // Container for key-value data.
 type Keys struct {
 	files *Directory
 	index *Index
+
+	// Format version of data files.
+	format      int
+	compression Compression
+
+	// Encrypts records, nil if encryption is disabled.
+	cipher *crypt.Cipher
+
+	// Clock for expiration of keys.
+	now func() time.Time
 }
 
-func OpenKeys(files *Directory, indexes *Directory) (*Keys, error) {
-	i, _ := OpenIndex(indexes, 100_000)
-	return &Keys{files: files, index: i}, nil
+func OpenKeys(files *Directory, indexes *Directory, opts ...Option) (*Keys, error) {
+	o := newOptions(opts...)
+	k := &Keys{files: files, format: o.Format, compression: o.Compression, now: o.Now}
+
+	if o.Keys != nil {
+		k.cipher = crypt.New(o.Keys)
+
+		if o.EncryptIndex {
+			indexes.Encrypt(k.cipher)
+		}
+	}
+
+	var err error
+
+	k.index, err = OpenIndex(indexes, 100_000, WithFormat(o.Format), WithBlockSize(o.BlockSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
 }
 
 // Store key on disk.
 func (k *Keys) Set(key, val []byte) (*Offset, error) {
+	return k.set(key, val, 0, 0)
+}
+
+// Store key on disk. Key expires after given ttl.
+func (k *Keys) SetWithTTL(key, val []byte, ttl time.Duration) (*Offset, error) {
+	return k.set(key, val, k.now().Add(ttl).UnixNano(), 0)
+}
+
+// Store key with given expiration time and version. If version is 0,
+// the next version of the key is used.
+func (k *Keys) set(key, val []byte, expires int64, version uint32) (*Offset, error) {
+	// We can only read from files in old format,
+	// writes must wait until they are migrated.
+	if k.format != FormatVersion {
+		return nil, ErrOutdatedFormat
+	}
+
+	if version == 0 {
+		current, err := k.index.Get(key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		version = current.Version + 1
+	}
+
 	file := k.files.Last
-	data, _ := Encode(key, val)
+
+	r, err := newRecord(key, val, k.compression)
+	if err != nil {
+		return nil, err
+	}
+	r.expires = expires
+
+	data, err := r.encode(k.cipher)
+	if err != nil {
+		return nil, err
+	}
 
 	// Write key data to file.
-	off, err := file.Write(data.Bytes())
+	off, err := file.Write(data)
 
 	if err != nil {
 		return nil, err
 	}
+	off.Version = version
 
 	// Write key to index.
 	err = k.index.Set(key, off)
@@ -36,24 +105,363 @@ func (k *Keys) Set(key, val []byte) (*Offset, error) {
 	return off, nil
 }
 
-// Get key from disk
+// Get key from disk. Expired keys are reported as not found.
+// Value is allocated per call, so DecodeView views into it stay valid.
 func (k *Keys) Get(key []byte) ([]byte, error) {
+	val, _, err := k.GetWithVersion(key)
+	return val, err
+}
+
+// Get key together with its version.
+func (k *Keys) GetWithVersion(key []byte) ([]byte, uint32, error) {
 	// Look up index
 	i, err := k.index.Get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if i.Deleted() {
+		return nil, 0, ErrNotFound
+	}
+
+	r, err := k.read(i)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if r.expired(k.now()) {
+		return nil, 0, ErrNotFound
+	}
+
+	val, err := r.value()
+	return val, i.Version, err
+}
+
+// Get value of the key even if it's already expired.
+func (k *Keys) current(key []byte) ([]byte, error) {
+	i, err := k.index.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if i.Deleted() {
+		return nil, ErrNotFound
+	}
+
+	r, err := k.read(i)
 	if err != nil {
 		return nil, err
 	}
 
+	return r.value()
+}
+
+// Iterate all live records, overwritten and expired ones are skipped.
+func (k *Keys) Each(fn func(key, val []byte) error) error {
+	return k.Scan(func(key, val []byte, off *Offset) error {
+		if !k.live(key, off) {
+			return nil
+		}
+
+		return fn(key, val)
+	})
+}
+
+// Get current version of the key. Missing and expired keys have version 0.
+func (k *Keys) Version(key []byte) (uint32, error) {
+	_, version, err := k.GetWithVersion(key)
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+	}
+
+	return version, err
+}
+
+// Get version of the key stored in index. Unlike Version, deleted and
+// expired keys report their last version, see Offset.Deleted.
+func (k *Keys) lastVersion(key []byte) (uint32, error) {
+	i, err := k.index.Get(key)
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+	}
+
+	return i.Version, err
+}
+
+// Delete key. Data stays in data files until compaction, index keeps
+// a tombstone with the key version, see Offset.Deleted.
+func (k *Keys) Delete(key []byte) error {
+	if k.format != FormatVersion {
+		return ErrOutdatedFormat
+	}
+
+	i, err := k.index.Get(key)
+	if err != nil {
+		return err
+	}
+
+	if i.Deleted() {
+		return ErrNotFound
+	}
+
+	return k.index.Set(key, &Offset{Version: i.Version})
+}
+
+// Rebuild corrupted index blocks from data files. Return the number
+// of repaired blocks and keys indexed again.
+//
+// Block holds offsets of keys hashed to it and of keys which didn't fit
+// the previous block, their latest records are indexed again. Data files
+// don't keep versions, so repaired keys get version above any version
+// left in index, to fail transactions which read them before. Deletes
+// aren't kept either, keys deleted since the last compaction come back,
+// check the returned keys.
+func (k *Keys) Repair() (int, [][]byte, error) {
+	if k.format != FormatVersion {
+		return 0, nil, ErrOutdatedFormat
+	}
+
+	blocks, err := k.index.Corrupted()
+	if err != nil || len(blocks) == 0 {
+		return 0, nil, err
+	}
+
+	max, err := k.index.MaxVersion()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	f := k.index.files.Last
+	corrupted := map[int64]bool{}
+
+	for _, n := range blocks {
+		corrupted[n] = true
+	}
+
+	// Find records first, so index is untouched if data can't be read.
+	offsets := map[string]*Offset{}
+
+	err = k.scan(func(r *record, off *Offset) error {
+		n := k.index.block(Hash(r.key))
+		if !corrupted[n] && !corrupted[(n+1)%f.BlockCount()] {
+			return nil
+		}
+
+		if r.expired(k.now()) {
+			delete(offsets, string(r.key))
+			return nil
+		}
+
+		offsets[string(r.key)] = off
+		return nil
+	})
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for _, n := range blocks {
+		err := f.clearBlock(n)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	keys := [][]byte{}
+
+	for key, off := range offsets {
+		// Key is stored in one of the healthy blocks.
+		_, err := k.index.Get([]byte(key))
+		if err == nil {
+			continue
+		}
+
+		if !errors.Is(err, ErrNotFound) {
+			return 0, nil, err
+		}
+
+		off.Version = max + 1
+
+		err = k.index.Set([]byte(key), off)
+		if err != nil {
+			return 0, nil, err
+		}
+		keys = append(keys, []byte(key))
+	}
+
+	return len(blocks), keys, nil
+}
+
+// Read record stored at given offset.
+func (k *Keys) read(off *Offset) (*record, error) {
 	// Get data file
-	f, _ := k.files.Get(int(i.FileID))
+	f, err := k.files.Get(int(off.FileID))
+	if err != nil {
+		return nil, err
+	}
+
+	// Corrupted offset could make us allocate gigabytes, check large
+	// ones against file size first.
+	if off.Size > 1<<20 && int64(off.Start)+int64(off.Size) > f.Size() {
+		return nil, fmt.Errorf("%w: offset %d+%d past end of file %d", ErrCorruptRecord, off.Start, off.Size, off.FileID)
+	}
 
 	// Read from file
-	buf := make([]byte, i.Size)
-	_, err = f.ReadAt(buf, int64(i.Start))
+	buf := make([]byte, off.Size)
+	_, err = f.ReadAt(buf, int64(off.Start))
+	if err != nil {
+		return nil, err
+	}
 
-	// Decode key/val
-	var val []byte
-	Decode(bytes.NewBuffer(buf), &key, &val)
+	// Decode key/val, buf is allocated per read so they can point into it
+	return readRecord(bytes.NewBuffer(buf), k.format, k.cipher, true)
+}
 
-	return val, err
+// Close data and index files.
+func (k *Keys) Close() error {
+	err := k.files.Close()
+	if err != nil {
+		return err
+	}
+
+	return k.index.files.Close()
+}
+
+// Check if record stored at given offset is the current one for key.
+func (k *Keys) live(key []byte, off *Offset) bool {
+	i, err := k.index.Get(key)
+	if err != nil {
+		return false
+	}
+
+	return !i.Deleted() && i.Same(off)
+}
+
+// Copy all live records to dst, overwritten, deleted and expired
+// records are skipped. Key versions and tombstones are preserved.
+func (k *Keys) CopyTo(dst *Keys) error {
+	tombstones, err := k.index.Tombstones()
+	if err != nil {
+		return err
+	}
+
+	for _, off := range tombstones {
+		err := dst.index.set(binary.NativeEndian.Uint64(off.Hash[:]), off)
+		if err != nil {
+			return err
+		}
+	}
+
+	return k.scan(func(r *record, off *Offset) error {
+		i, err := k.index.Get(r.key)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// Record was overwritten or deleted.
+		if i.Deleted() || !i.Same(off) {
+			return nil
+		}
+
+		// Expired key is dropped, but its version must survive.
+		if r.expired(k.now()) {
+			return dst.index.Set(r.key, &Offset{Version: i.Version})
+		}
+
+		val, err := r.value()
+		if err != nil {
+			return err
+		}
+
+		// Offsets in old formats don't have versions.
+		version := max(i.Version, 1)
+
+		_, err = dst.set(r.key, val, r.expires, version)
+		return err
+	})
+}
+
+// Get all live keys which are already expired.
+func (k *Keys) Expired() ([][]byte, error) {
+	keys := [][]byte{}
+
+	err := k.scan(func(r *record, off *Offset) error {
+		if r.expired(k.now()) && k.live(r.key, off) {
+			keys = append(keys, r.key)
+		}
+		return nil
+	})
+
+	return keys, err
+}
+
+// Iterate all records stored in data files, in the order they were written.
+// Records that were overwritten later are also passed to fn, expired are not.
+func (k *Keys) Scan(fn func(key, val []byte, off *Offset) error) error {
+	return k.scan(func(r *record, off *Offset) error {
+		if r.expired(k.now()) {
+			return nil
+		}
+
+		val, err := r.value()
+		if err != nil {
+			return err
+		}
+
+		return fn(r.key, val, off)
+	})
+}
+
+func (k *Keys) scan(fn func(r *record, off *Offset) error) error {
+	for id := 1; id <= k.files.Max(); id++ {
+		f, err := k.files.Get(id)
+		if err != nil {
+			return err
+		}
+
+		err = k.scanFile(f, fn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Iterate all records stored in given data file.
+func (k *Keys) scanFile(f *File, fn func(r *record, off *Offset) error) error {
+	data := make([]byte, f.Size())
+
+	_, err := f.ReadAt(data, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	buf := bytes.NewBuffer(data)
+
+	for buf.Len() > 0 {
+		start := len(data) - buf.Len()
+
+		r, err := readRecord(buf, k.format, k.cipher, false)
+		if err != nil {
+			return err
+		}
+
+		off := &Offset{
+			FileID: uint32(f.ID),
+			Start:  uint32(start),
+			Size:   uint32(len(data) - buf.Len() - start),
+		}
+
+		err = fn(r, off)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
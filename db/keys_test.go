@@ -1,10 +1,15 @@
 package db
 
 import (
+	"bucketdb/db/crypt"
 	"bucketdb/tests"
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"testing"
+	"time"
 )
 
 func TestKeysSetGet(t *testing.T) {
@@ -32,3 +37,155 @@ func TestKeysSetGet(t *testing.T) {
 		tests.Assert(t, v, string(val[:]))
 	}
 }
+
+func TestKeysCompression(t *testing.T) {
+	index := Dir("./test/index", 10, "bin")
+	dataDir := Dir("./test", 10, "bin")
+	defer os.RemoveAll("./test")
+
+	kv, _ := OpenKeys(dataDir, index, WithCompression(Flate))
+
+	small := []byte("val")
+	large := bytes.Repeat([]byte(`{"hello":"world"}`), 100)
+
+	kv.Set([]byte("small"), small)
+	off, _ := kv.Set([]byte("large"), large)
+
+	// Value should be compressed.
+	tests.Assert(t, true, int(off.Size) < len(large))
+
+	// Both compressed and uncompressed records can be read.
+	val, _ := kv.Get([]byte("small"))
+	tests.AssertEqual(t, small, val)
+
+	val, _ = kv.Get([]byte("large"))
+	tests.AssertEqual(t, large, val)
+
+	// Records written without compression are still readable.
+	kv.compression = NoCompression
+	kv.Set([]byte("plain"), large)
+
+	val, _ = kv.Get([]byte("plain"))
+	tests.AssertEqual(t, large, val)
+}
+
+func TestRecordModes(t *testing.T) {
+	// Records written before format 4 use default bitbox mode.
+	raw, _ := Encode([]byte("key"), []byte("val"))
+	old := append([]byte{0}, raw.Bytes()...)
+
+	r, err := readRecord(bytes.NewBuffer(old), 3, nil, false)
+	tests.Assert(t, nil, err)
+	tests.Assert(t, "key", string(r.key))
+	tests.Assert(t, "val", string(r.val))
+
+	// New records are written in varint mode and are smaller.
+	data, err := (&record{key: []byte("key"), val: []byte("val")}).encode(nil)
+	tests.Assert(t, nil, err)
+	tests.Assert(t, len(old)-14, len(data))
+
+	r, err = readRecord(bytes.NewBuffer(data), FormatVersion, nil, true)
+	tests.Assert(t, nil, err)
+	tests.Assert(t, "key", string(r.key))
+	tests.Assert(t, "val", string(r.val))
+}
+
+func TestKeysCorruptOffset(t *testing.T) {
+	index := Dir("./test/index", 10, "bin")
+	dataDir := Dir("./test", 10, "bin")
+	defer os.RemoveAll("./test")
+
+	kv, _ := OpenKeys(dataDir, index)
+	off, err := kv.Set([]byte("key"), []byte("val"))
+	tests.Assert(t, nil, err)
+
+	off.Size = 1 << 30
+	_, err = kv.read(off)
+	tests.Assert(t, true, errors.Is(err, ErrCorruptRecord))
+}
+
+func FuzzReadRecord(f *testing.F) {
+	c := crypt.New(crypt.NewKeyRing(1, bytes.Repeat([]byte{1}, 32)))
+
+	plain, _ := newRecord([]byte("key"), []byte("val"), NoCompression)
+	packed, _ := newRecord([]byte("key"), bytes.Repeat([]byte("val"), 100), Gzip)
+	expiring := &record{key: []byte("key"), val: []byte("val"), expires: 1}
+
+	for _, r := range []*record{plain, packed, expiring} {
+		data, _ := r.encode(nil)
+		f.Add(data, uint8(FormatVersion), false)
+
+		data, _ = r.encode(c)
+		f.Add(data, uint8(FormatVersion), true)
+	}
+
+	old, _ := Encode([]byte("key"), []byte("val"))
+	f.Add(old.Bytes(), uint8(1), false)
+
+	f.Fuzz(func(t *testing.T, data []byte, version uint8, encrypted bool) {
+		var cipher *crypt.Cipher
+		if encrypted {
+			cipher = c
+		}
+
+		r, err := readRecord(bytes.NewBuffer(data), int(version%(FormatVersion+1)), cipher, version&0x80 != 0)
+		if err != nil {
+			return
+		}
+
+		r.expired(time.Now())
+		r.value()
+	})
+}
+
+func TestKeysRepair(t *testing.T) {
+	testKeysRepair(t)
+
+	// Torn encrypted block fails authentication.
+	ring := crypt.NewKeyRing(1, bytes.Repeat([]byte{1}, 32))
+	testKeysRepair(t, WithEncryption(ring), WithIndexEncryption())
+}
+
+func testKeysRepair(t *testing.T, opts ...Option) {
+	index := Dir("./test/index", 10, "bin")
+	dataDir := Dir("./test", 10, "bin")
+	defer os.RemoveAll("./test")
+
+	kv, _ := OpenKeys(dataDir, index, opts...)
+	defer kv.Close()
+
+	for i := 0; i < 1000; i++ {
+		kv.Set([]byte(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("val_%d", i)))
+	}
+	kv.Set([]byte("key_0"), []byte("new"))
+	kv.Set([]byte("key_1"), []byte("new"))
+	kv.Set([]byte("key_1"), []byte("newer"))
+
+	// Flip a byte of the block holding key_0, like a torn write would.
+	f := kv.index.files.Last
+	n := kv.index.block(Hash([]byte("key_0")))
+	f.file.WriteAt([]byte{0xff}, n*f.blockSize+100)
+
+	_, err := kv.Get([]byte("key_0"))
+	tests.Assert(t, true, errors.Is(err, ErrCorruptBlock))
+
+	repaired, keys, err := kv.Repair()
+	tests.AssertEqual(t, nil, err)
+	tests.Assert(t, 1, repaired)
+	tests.Assert(t, true, slices.ContainsFunc(keys, func(key []byte) bool {
+		return string(key) == "key_0"
+	}))
+
+	// Version is above the highest one in index, key_1 has 3.
+	val, version, _ := kv.GetWithVersion([]byte("key_0"))
+	tests.AssertEqual(t, []byte("new"), val)
+	tests.Assert(t, true, version > 3)
+
+	for i := 2; i < 1000; i++ {
+		val, _ := kv.Get([]byte(fmt.Sprintf("key_%d", i)))
+		tests.AssertEqual(t, []byte(fmt.Sprintf("val_%d", i)), val)
+	}
+
+	repaired, _, _ = kv.Repair()
+	tests.Assert(t, 0, repaired)
+}
@@ -0,0 +1,124 @@
+package migrate
+
+import (
+	"bucketdb/db"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Migrator rewrites collections to the current format in background.
+type Migrator struct {
+	db *db.DB
+
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	errors []error
+}
+
+// Start migrating all collections in database. Reads are served from
+// the old files until collection is fully rewritten.
+func Start(d *db.DB) (*Migrator, error) {
+	names, err := d.Collections()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Migrator{db: d}
+
+	for _, name := range names {
+		c, err := d.Collection(name)
+		if err != nil {
+			m.errors = append(m.errors, fmt.Errorf("collection %s: %w", name, err))
+			continue
+		}
+
+		if c.Format() == db.FormatVersion {
+			continue
+		}
+
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+
+			err := Collection(c)
+			if err != nil {
+				m.mu.Lock()
+				m.errors = append(m.errors, fmt.Errorf("collection %s: %w", c.Name(), err))
+				m.mu.Unlock()
+			}
+		}()
+	}
+
+	return m, nil
+}
+
+// Wait until all migrations are done. Return first error if any.
+func (m *Migrator) Wait() error {
+	m.wg.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.errors) > 0 {
+		return m.errors[0]
+	}
+
+	return nil
+}
+
+// Migrate collection to the current format.
+//
+// All live records are rewritten into a temporary directory next to the
+// collection, after that both directories are swapped.
+func Collection(c *db.Collection) error {
+	version := c.Format()
+
+	if version == db.FormatVersion {
+		return nil
+	}
+
+	if version > db.FormatVersion {
+		return fmt.Errorf("format %d is newer than supported %d", version, db.FormatVersion)
+	}
+
+	// Remove leftovers from previous (interrupted) migration.
+	tmp := c.Root() + ".migrate"
+	err := os.RemoveAll(tmp)
+	if err != nil {
+		return err
+	}
+
+	keys, err := db.OpenKeys(db.DataDir(tmp), db.IndexDir(tmp), c.Options()...)
+	if err != nil {
+		return err
+	}
+
+	// Open old files separately, collection is still serving reads from
+	// them. Keep collection options, ex: encryption keys.
+	opts := append(append([]db.Option{}, c.Options()...), db.WithFormat(version))
+
+	old, err := db.OpenKeys(db.DataDir(c.Root()), db.IndexDir(c.Root()), opts...)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+
+	err = old.CopyTo(keys)
+	if err != nil {
+		keys.Close()
+		return err
+	}
+
+	err = keys.Close()
+	if err != nil {
+		return err
+	}
+
+	err = db.WriteFormat(tmp, db.FormatVersion)
+	if err != nil {
+		return err
+	}
+
+	return c.Swap(tmp)
+}
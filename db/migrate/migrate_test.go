@@ -0,0 +1,98 @@
+package migrate
+
+import (
+	"bucketdb/db"
+	"bucketdb/db/crypt"
+	"bucketdb/tests"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateCollection(t *testing.T) {
+	d, _ := db.Open("./test")
+	defer d.Delete()
+
+	// Create collection without FORMAT file, the way it was stored
+	// before format versions were introduced.
+	root := filepath.Join(d.Root(), db.CollectionsPath, "legacy")
+	data := db.DataDir(root)
+	index, _ := db.OpenIndex(db.IndexDir(root), 100_000, db.WithFormat(1))
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		raw, _ := db.Encode(key, []byte(fmt.Sprintf("val_%d", i)))
+
+		off, _ := data.Last.Write(raw.Bytes())
+		index.Set(key, off)
+	}
+	data.Close()
+
+	c, _ := d.Collection("legacy")
+	tests.Assert(t, 0, c.Format())
+
+	// Old collections are read only.
+	_, err := c.Set([]byte("key"), []byte("val"))
+	tests.Assert(t, true, errors.Is(err, db.ErrOutdatedFormat))
+
+	val, _ := c.Get([]byte("key_10"))
+	tests.Assert(t, "val_10", string(val))
+
+	m, _ := Start(d)
+	tests.Assert(t, nil, m.Wait())
+	tests.Assert(t, db.FormatVersion, c.Format())
+
+	for i := 0; i < 100; i++ {
+		val, _ := c.Get([]byte(fmt.Sprintf("key_%d", i)))
+		tests.Assert(t, fmt.Sprintf("val_%d", i), string(val))
+	}
+
+	_, err = c.Set([]byte("key"), []byte("val"))
+	tests.Assert(t, nil, err)
+
+	// Temporary directories should be gone.
+	_, err = os.Stat(root + ".migrate")
+	tests.Assert(t, true, os.IsNotExist(err))
+
+	names, _ := d.Collections()
+	tests.AssertEqual(t, []string{"legacy"}, names)
+}
+
+func TestMigrateEncrypted(t *testing.T) {
+	ring := crypt.NewKeyRing(1, bytes.Repeat([]byte{1}, 32))
+	opts := []db.Option{db.WithEncryption(ring), db.WithIndexEncryption()}
+
+	d, _ := db.Open("./test", opts...)
+	defer os.RemoveAll("./test")
+
+	c, _ := d.Collection("secret")
+	for i := 0; i < 100; i++ {
+		c.Set([]byte(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("val_%d", i)))
+	}
+	d.Close()
+
+	// Blocks without checksum, collection must be migrated.
+	db.WriteFormat(c.Root(), 6)
+
+	d, _ = db.Open("./test", opts...)
+	defer d.Close()
+
+	c, _ = d.Collection("secret")
+	tests.Assert(t, 6, c.Format())
+
+	m, _ := Start(d)
+	tests.Assert(t, nil, m.Wait())
+	tests.Assert(t, db.FormatVersion, c.Format())
+
+	for i := 0; i < 100; i++ {
+		val, err := c.Get([]byte(fmt.Sprintf("key_%d", i)))
+		tests.Assert(t, nil, err)
+		tests.Assert(t, fmt.Sprintf("val_%d", i), string(val))
+	}
+
+	_, err := c.Set([]byte("key"), []byte("val"))
+	tests.Assert(t, nil, err)
+}
@@ -48,6 +48,26 @@ func (m *Mmap) Sync() error {
 	return unix.Msync(m.data, unix.MS_SYNC)
 }
 
+// Size of mmaped region.
+func (m *Mmap) Len() int {
+	return len(m.data)
+}
+
+// Sync data, unmap and close the file.
+func (m *Mmap) Close() error {
+	err := m.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = unix.Munmap(m.data)
+	if err != nil {
+		return err
+	}
+
+	return m.file.Close()
+}
+
 // Write to mmaped file.
 func (m *Mmap) Write(bytes []byte) int {
 	n := copy(m.data[m.WriteOffset:], bytes)
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"bucketdb/db/crypt"
+	"log"
+	"time"
+)
+
+// Options for collections and their key-value containers.
+type Options struct {
+	// Compression used for values of new records.
+	Compression Compression
+
+	// Format version of existing files. Defaults to FormatVersion.
+	Format int
+
+	// Keys for encrypting records at rest. Nil disables encryption.
+	Keys crypt.KeyProvider
+
+	// Encrypt index blocks too, requires Keys.
+	EncryptIndex bool
+
+	// Size of index blocks of new files. Existing files keep the size
+	// they were created with.
+	BlockSize int
+
+	// Clock used for expiration of keys. Defaults to time.Now.
+	Now func() time.Time
+
+	// Size of transaction logs of collections and database, the biggest
+	// transaction must fit into it. Each log is memory mapped.
+	WalSize int64
+
+	// Called with errors of background tasks, ex: reaper. Defaults to
+	// the standard logger.
+	OnError func(error)
+}
+
+type Option func(*Options)
+
+// Compress values of new records with given algorithm.
+func WithCompression(c Compression) Option {
+	return func(o *Options) { o.Compression = c }
+}
+
+// Encrypt records with keys from given provider.
+func WithEncryption(keys crypt.KeyProvider) Option {
+	return func(o *Options) { o.Keys = keys }
+}
+
+// Encrypt index blocks, must be used together with WithEncryption.
+func WithIndexEncryption() Option {
+	return func(o *Options) { o.EncryptIndex = true }
+}
+
+// Use index blocks of given size for new files, 4 to 64 KiB, power
+// of two. Larger blocks take more keys before they overflow to the next
+// one, but each lookup reads more bytes.
+func WithBlockSize(size int) Option {
+	return func(o *Options) { o.BlockSize = size }
+}
+
+// Use given clock for expiration of keys, ex: to control time in tests.
+func WithClock(now func() time.Time) Option {
+	return func(o *Options) { o.Now = now }
+}
+
+// Report errors of background tasks to fn.
+func WithErrorHandler(fn func(error)) Option {
+	return func(o *Options) { o.OnError = fn }
+}
+
+// Use transaction logs of given size. Logs of transactions interrupted
+// by crash must be applied before the size is reduced.
+func WithWalSize(size int64) Option {
+	return func(o *Options) { o.WalSize = size }
+}
+
+// Read files stored in given format version.
+func WithFormat(version int) Option {
+	return func(o *Options) { o.Format = version }
+}
+
+func newOptions(opts ...Option) *Options {
+	o := &Options{
+		Format:    FormatVersion,
+		BlockSize: DefaultBlockSize,
+		WalSize:   DefaultWalSize,
+		Now:       time.Now,
+		OnError:   func(err error) { log.Printf("bucketdb: %v", err) },
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
@@ -0,0 +1,86 @@
+package page
+
+import (
+	"errors"
+	"hash/crc32"
+	"unsafe"
+)
+
+var ErrChecksum = errors.New("page checksum mismatch")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum field position in header.
+const checksumOffset = int(unsafe.Offsetof(Header{}.Checksum))
+
+// Compute CRC32C of the page and store it in header. Checksum field
+// itself is skipped, so it can be verified in place.
+func Seal(data []byte) error {
+	h, err := Of(data)
+	if err != nil {
+		return err
+	}
+
+	h.Checksum = Sum(data)
+	return nil
+}
+
+// Verify checksum of the page, ex: to detect torn writes. Only pages
+// which were never written (all zero) may have no checksum.
+func Verify(data []byte) error {
+	return verify(data, false)
+}
+
+// Like Verify, but pages without checksum are valid too, ex: pages
+// written before checksums were added.
+func VerifyUnsealed(data []byte) error {
+	return verify(data, true)
+}
+
+func verify(data []byte, unsealed bool) error {
+	h, err := Of(data)
+	if err != nil {
+		return err
+	}
+
+	if h.Checksum == 0 {
+		// Header of empty page survived but some of its data was written.
+		if (h.Type == Empty || !unsealed) && !zero(data) {
+			return ErrChecksum
+		}
+
+		return nil
+	}
+
+	if h.Checksum != Sum(data) {
+		return ErrChecksum
+	}
+
+	return nil
+}
+
+// CRC32C of the page without checksum field.
+func Sum(data []byte) uint32 {
+	var empty [4]byte
+
+	crc := crc32.Update(0, castagnoli, data[:checksumOffset])
+	crc = crc32.Update(crc, castagnoli, empty[:])
+	crc = crc32.Update(crc, castagnoli, data[checksumOffset+4:])
+
+	// 0 is reserved for pages without checksum.
+	if crc == 0 {
+		return 1
+	}
+
+	return crc
+}
+
+func zero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,143 @@
+// Package page defines the header shared by all fixed size pages
+// (blocks) stored on disk, so tooling and caches can handle index and
+// data pages the same way.
+//
+// Page layout:
+//
+//	header (HeaderSize bytes) | payload
+//
+// Header fields are stored in native byte order, pages are mapped
+// directly onto file bytes.
+//
+// Pages are 4 to 64 KiB, power of two. Each header keeps size of its
+// page, so the header of the first page serves as the file header.
+package page
+
+import (
+	"errors"
+	"math/bits"
+	"unsafe"
+)
+
+var (
+	ErrInvalidHeader = errors.New("invalid page header")
+	ErrSize          = errors.New("page size must be a power of two between 4 and 64 KiB")
+)
+
+const (
+	MinSize = 4 << 10
+	MaxSize = 64 << 10
+)
+
+// Type of the page payload.
+type Type uint8
+
+const (
+	// Page was never written, all bytes are zero.
+	Empty Type = iota
+
+	// Fixed size entries appended one after another, ex: index offsets.
+	Raw
+
+	// Variable size records with slot directory.
+	Slotted
+)
+
+func (t Type) String() string {
+	switch t {
+	case Empty:
+		return "empty"
+	case Raw:
+		return "raw"
+	case Slotted:
+		return "slotted"
+	}
+
+	return "unknown"
+}
+
+type Header struct {
+	Type Type
+
+	// Log2 of page size, 0 for pages written before it was stored.
+	Shift uint8
+	_     [2]byte
+
+	// CRC32C of the page, 0 if not computed. See Seal.
+	Checksum uint32
+
+	// Reserved for log sequence number of the last change. Nothing
+	// writes it yet, it's always 0.
+	LSN uint64
+
+	// Bytes of payload in use and bytes still free.
+	Len  int32
+	Free int32
+}
+
+const HeaderSize = int(unsafe.Sizeof(Header{}))
+
+// Get header of the page. It points directly to page bytes, so all
+// changes are visible in data.
+func Of(data []byte) (*Header, error) {
+	if len(data) < HeaderSize {
+		return nil, ErrInvalidHeader
+	}
+
+	h := (*Header)(unsafe.Pointer(&data[0]))
+	return h, h.check(len(data))
+}
+
+// Initialize header of empty page, all payload is free.
+func (h *Header) Init(t Type, size int) {
+	*h = Header{Type: t, Free: int32(size - HeaderSize)}
+}
+
+// Size of the page on disk, see SetSize.
+func (h *Header) Size() int {
+	if h.Shift == 0 {
+		return MinSize
+	}
+
+	return 1 << h.Shift
+}
+
+// Store size of the page on disk. It can differ from the size of page
+// data, ex: encrypted pages lose space for cipher overhead.
+func (h *Header) SetSize(size int) {
+	h.Shift = uint8(bits.TrailingZeros(uint(size)))
+}
+
+// Check if page size is supported.
+func CheckSize(size int) error {
+	if size < MinSize || size > MaxSize || size&(size-1) != 0 {
+		return ErrSize
+	}
+
+	return nil
+}
+
+// Size of page payload.
+func Payload(size int) int {
+	return size - HeaderSize
+}
+
+// Check header against page size, so corrupted headers don't make us
+// read outside the page.
+func (h *Header) check(size int) error {
+	payload := Payload(size)
+
+	if h.Type > Slotted {
+		return ErrInvalidHeader
+	}
+
+	if h.Shift != 0 && CheckSize(h.Size()) != nil {
+		return ErrInvalidHeader
+	}
+
+	if h.Len < 0 || int(h.Len) > payload || h.Free < 0 || int(h.Free) > payload {
+		return ErrInvalidHeader
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package page
+
+import (
+	"bucketdb/tests"
+	"testing"
+)
+
+func TestHeader(t *testing.T) {
+	data := make([]byte, 4096)
+
+	h, err := Of(data)
+	tests.AssertEqual(t, nil, err)
+	tests.Assert(t, Empty, h.Type)
+
+	h.Init(Slotted, len(data))
+	h.Len = 10
+
+	// Header points to page bytes.
+	h2, _ := Of(data)
+	tests.Assert(t, Slotted, h2.Type)
+	tests.Assert(t, 10, h2.Len)
+	tests.Assert(t, int32(Payload(4096)), h2.Free)
+}
+
+func TestHeaderInvalid(t *testing.T) {
+	_, err := Of(make([]byte, HeaderSize-1))
+	tests.AssertEqual(t, ErrInvalidHeader, err)
+
+	data := make([]byte, 64)
+	h, _ := Of(data)
+
+	h.Type = 9
+	_, err = Of(data)
+	tests.AssertEqual(t, ErrInvalidHeader, err)
+
+	h.Type = Raw
+	h.Len = int32(Payload(64) + 1)
+	_, err = Of(data)
+	tests.AssertEqual(t, ErrInvalidHeader, err)
+
+	h.Len = 0
+	h.Free = -1
+	_, err = Of(data)
+	tests.AssertEqual(t, ErrInvalidHeader, err)
+}
+
+func TestChecksum(t *testing.T) {
+	data := make([]byte, 4096)
+	tests.AssertEqual(t, nil, Verify(data))
+
+	h, _ := Of(data)
+	h.Init(Raw, len(data))
+	copy(data[HeaderSize:], "hello")
+	h.Len = 5
+
+	// Checksum is not computed yet, only valid for unsealed pages.
+	tests.AssertEqual(t, ErrChecksum, Verify(data))
+	tests.AssertEqual(t, nil, VerifyUnsealed(data))
+
+	Seal(data)
+	tests.Assert(t, true, h.Checksum != 0)
+	tests.AssertEqual(t, nil, Verify(data))
+
+	data[HeaderSize] = 'j'
+	tests.AssertEqual(t, ErrChecksum, Verify(data))
+	tests.AssertEqual(t, ErrChecksum, VerifyUnsealed(data))
+
+	data[HeaderSize] = 'h'
+	h.LSN = 7
+	tests.AssertEqual(t, ErrChecksum, Verify(data))
+
+	// Checksum zeroed by torn write.
+	h.LSN = 0
+	h.Checksum = 0
+	tests.AssertEqual(t, ErrChecksum, Verify(data))
+
+	// Header zeroed by torn write.
+	copy(data, make([]byte, HeaderSize))
+	tests.AssertEqual(t, ErrChecksum, VerifyUnsealed(data))
+}
+
+func TestHeaderSize(t *testing.T) {
+	data := make([]byte, 64)
+	h, _ := Of(data)
+
+	// Pages written before sizes were stored.
+	tests.Assert(t, MinSize, h.Size())
+
+	h.SetSize(32 << 10)
+	tests.Assert(t, 32<<10, h.Size())
+
+	h.Shift = 40
+	_, err := Of(data)
+	tests.AssertEqual(t, ErrInvalidHeader, err)
+
+	tests.AssertEqual(t, nil, CheckSize(MaxSize))
+	tests.AssertEqual(t, ErrSize, CheckSize(MinSize/2))
+	tests.AssertEqual(t, ErrSize, CheckSize(MinSize+1))
+}
@@ -0,0 +1,194 @@
+package db
+
+import (
+	"bucketdb/db/crypt"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	ErrNoCipher      = errors.New("record is encrypted but no keys were provided")
+	ErrCorruptRecord = errors.New("record is corrupted")
+)
+
+// Record flags, stored in the first byte of each record.
+//
+// The lowest 3 bits keep the compression algorithm used for value.
+const (
+	flagCompression uint8 = 0b111
+	flagEncrypted   uint8 = 1 << 3
+	flagExpires     uint8 = 1 << 4
+	flagVarint      uint8 = 1 << 5
+)
+
+// Key-value record stored in data files.
+//
+// Format 2 layout:
+//
+//	flags | expires (if flagExpires) | key (bitbox) | value (bitbox)
+//
+// Encrypted records keep key and value sealed together:
+//
+//	flags | expires (if flagExpires) | sealed key and value (bitbox)
+//
+// Since format 4 records are bitbox encoded in Varint mode (flagVarint).
+// Format 1 records don't have flags.
+type record struct {
+	flags uint8
+	key   []byte
+	val   []byte
+
+	// Expiration time in unix nanoseconds, 0 if record never expires.
+	expires int64
+}
+
+// Create record, compressing value if it's worth it.
+func newRecord(key, val []byte, c Compression) (*record, error) {
+	r := &record{key: key, val: val}
+
+	if c == NoCompression {
+		return r, nil
+	}
+
+	data, err := compress(c, val)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep value uncompressed if compression doesn't save anything,
+	// ex: for small or already compressed values.
+	if len(data) < len(val) {
+		r.val = data
+		r.flags |= uint8(c)
+	}
+
+	return r, nil
+}
+
+// Check if record is expired at given time.
+func (r *record) expired(now time.Time) bool {
+	return r.expires != 0 && r.expires <= now.UnixNano()
+}
+
+// Encode record in current format. Key and value are encrypted if cipher is given.
+func (r *record) encode(c *crypt.Cipher) ([]byte, error) {
+	raw, err := Varint.Encode(r.key, r.val)
+	if err != nil {
+		return nil, err
+	}
+
+	flags := r.flags | flagVarint
+	if c != nil {
+		flags |= flagEncrypted
+	}
+
+	if r.expires != 0 {
+		flags |= flagExpires
+	}
+
+	header := []byte{flags}
+	if r.expires != 0 {
+		header = binary.BigEndian.AppendUint64(header, uint64(r.expires))
+	}
+
+	if c == nil {
+		return append(header, raw.Bytes()...), nil
+	}
+
+	sealed, err := c.Seal(raw.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err = Varint.Encode(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(header, raw.Bytes()...), nil
+}
+
+// Read record stored in given format version. Cipher is required only
+// for encrypted records. With view, key and value of plain records
+// point into buf, so buf must not be reused while record is in use.
+func readRecord(buf *bytes.Buffer, version int, c *crypt.Cipher, view bool) (*record, error) {
+	r := &record{}
+
+	if version >= 2 {
+		flags, err := buf.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: missing flags", ErrCorruptRecord)
+		}
+		r.flags = flags
+	}
+
+	if r.flags&flagExpires != 0 {
+		expires := [8]byte{}
+
+		_, err := io.ReadFull(buf, expires[:])
+		if err != nil {
+			return nil, fmt.Errorf("%w: missing expiration", ErrCorruptRecord)
+		}
+		r.expires = int64(binary.BigEndian.Uint64(expires[:]))
+	}
+
+	mode := DefaultMode
+	if r.flags&flagVarint != 0 {
+		mode = Varint
+	}
+
+	if r.flags&flagEncrypted == 0 {
+		if view {
+			mode |= View
+		}
+
+		err := mode.Decode(buf, &r.key, &r.val)
+		if err != nil {
+			return nil, err
+		}
+
+		return r, nil
+	}
+
+	if c == nil {
+		return nil, ErrNoCipher
+	}
+
+	// Sealed bytes are copied by Open, decrypted ones are ours.
+	var sealed []byte
+	err := (mode | View).Decode(buf, &sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := c.Open(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt record: %w", err)
+	}
+
+	err = (mode | View).Decode(bytes.NewBuffer(raw), &r.key, &r.val)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Get original value, decompressing it if needed.
+func (r *record) value() ([]byte, error) {
+	c := Compression(r.flags & flagCompression)
+	if c == NoCompression {
+		return r.val, nil
+	}
+
+	val, err := decompress(c, r.val)
+	if err != nil {
+		return nil, fmt.Errorf("decompress record: %w", err)
+	}
+
+	return val, nil
+}
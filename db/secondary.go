@@ -0,0 +1,285 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrIndexExists  = errors.New("index already exists")
+	ErrIndexMissing = errors.New("index doesn't exist")
+)
+
+// Secondary index, maps values extracted from collection values
+// to primary keys.
+type secondary struct {
+	extract func(val []byte) [][]byte
+
+	// Stores value -> primary keys.
+	keys *Keys
+}
+
+// Create secondary index with given name. Extractor returns values under
+// which the key should be indexed, ex: decoded struct fields.
+//
+// Extractors are not persisted, index must be created each time collection
+// is opened. Index is built from existing keys the first time, and again
+// if collection was written while index wasn't created, see markStale.
+func (c *Collection) CreateIndex(name string, extract func(val []byte) [][]byte) error {
+	c.lock()
+	defer c.unlock()
+
+	if _, ok := c.indexes[name]; ok {
+		return ErrIndexExists
+	}
+
+	root := filepath.Join(c.root, "indexes", name)
+
+	// Index is new or was written in old format, (re)build it.
+	version, err := ReadFormat(root)
+	if err != nil {
+		return err
+	}
+
+	build := version != FormatVersion
+	if !build {
+		_, err := os.Stat(filepath.Join(root, "keys"))
+		build = os.IsNotExist(err)
+	}
+
+	if build {
+		err := os.RemoveAll(root)
+		if err != nil {
+			return err
+		}
+	}
+
+	keys, err := OpenKeys(DataDir(root), IndexDir(root), c.opts...)
+	if err != nil {
+		return err
+	}
+
+	idx := &secondary{extract: extract, keys: keys}
+
+	if build {
+		err := c.keys.Each(func(key, val []byte) error {
+			return idx.update(key, nil, val)
+		})
+
+		if err != nil {
+			keys.Close()
+			return err
+		}
+
+		err = WriteFormat(root, FormatVersion)
+		if err != nil {
+			keys.Close()
+			return err
+		}
+	}
+
+	c.indexes[name] = idx
+	return nil
+}
+
+// Get primary keys indexed under given value. Expired keys stay in
+// indexes until they are reaped, they are skipped.
+func (c *Collection) GetBy(index string, value []byte) ([][]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	idx, ok := c.indexes[index]
+	if !ok {
+		return nil, ErrIndexMissing
+	}
+
+	keys, err := idx.get(value)
+	if err != nil {
+		return nil, err
+	}
+
+	live := [][]byte{}
+	for _, key := range keys {
+		_, err := c.keys.Get(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		live = append(live, key)
+	}
+
+	return live, nil
+}
+
+// Mark secondary indexes stored on disk, which weren't created since
+// collection was opened, as stale. They would miss the next write, so
+// they are rebuilt by CreateIndex. Collection must be locked.
+func (c *Collection) markStale() error {
+	if c.marked {
+		return nil
+	}
+
+	root := filepath.Join(c.root, "indexes")
+
+	entries, err := os.ReadDir(root)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	for _, e := range entries {
+		if _, ok := c.indexes[e.Name()]; ok {
+			continue
+		}
+
+		// Index without FORMAT file is treated as old and rebuilt.
+		err := os.Remove(filepath.Join(root, e.Name(), FormatFile))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	c.marked = true
+	return nil
+}
+
+// Update all secondary indexes after key changed from old to new value.
+// Nil value means key didn't exist or was deleted.
+func (c *Collection) reindex(key, old, new []byte) error {
+	for _, idx := range c.indexes {
+		err := idx.update(key, old, new)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *secondary) update(key, old, new []byte) error {
+	var before, after [][]byte
+
+	if old != nil {
+		before = s.extract(old)
+	}
+
+	if new != nil {
+		after = s.extract(new)
+	}
+
+	for _, value := range before {
+		if contains(after, value) {
+			continue
+		}
+
+		err := s.remove(value, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, value := range after {
+		if contains(before, value) {
+			continue
+		}
+
+		err := s.add(value, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get primary keys for value.
+func (s *secondary) get(value []byte) ([][]byte, error) {
+	raw, err := s.keys.Get(value)
+	if errors.Is(err, ErrNotFound) {
+		return [][]byte{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Primary keys are stored one after another, each one with varint
+	// length prefix.
+	keys := [][]byte{}
+	buf := bytes.NewBuffer(raw)
+
+	for buf.Len() > 0 {
+		var key []byte
+
+		err := Varint.Decode(buf, &key)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func (s *secondary) set(value []byte, keys [][]byte) error {
+	if len(keys) == 0 {
+		return s.keys.Delete(value)
+	}
+
+	buf := new(bytes.Buffer)
+	for _, key := range keys {
+		Varint.EncodeTo(buf, key)
+	}
+
+	_, err := s.keys.Set(value, buf.Bytes())
+	return err
+}
+
+// Add primary key to value.
+func (s *secondary) add(value, key []byte) error {
+	keys, err := s.get(value)
+	if err != nil {
+		return err
+	}
+
+	if contains(keys, key) {
+		return nil
+	}
+
+	return s.set(value, append(keys, key))
+}
+
+// Remove primary key from value.
+func (s *secondary) remove(value, key []byte) error {
+	keys, err := s.get(value)
+	if err != nil {
+		return err
+	}
+
+	i := indexOf(keys, key)
+	if i == -1 {
+		return nil
+	}
+
+	return s.set(value, append(keys[:i], keys[i+1:]...))
+}
+
+func contains(list [][]byte, elem []byte) bool {
+	return indexOf(list, elem) != -1
+}
+
+func indexOf(list [][]byte, elem []byte) int {
+	for i, e := range list {
+		if bytes.Equal(e, elem) {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"bucketdb/tests"
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type Transfer struct {
+	From  common.Address
+	Value uint64
+}
+
+func byFrom(val []byte) [][]byte {
+	tr := Transfer{}
+	Decode(bytes.NewBuffer(val), &tr)
+
+	return [][]byte{tr.From[:]}
+}
+
+func TestCollectionSecondaryIndex(t *testing.T) {
+	c, _ := OpenCollection("test", "./test")
+	defer os.RemoveAll("./test")
+
+	alice := common.Address{1}
+	bob := common.Address{2}
+
+	set := func(key string, from common.Address) {
+		raw, _ := Encode(Transfer{From: from, Value: 10})
+		c.Set([]byte(key), raw.Bytes())
+	}
+
+	// Keys set before index was created.
+	set("tx1", alice)
+
+	tests.Assert(t, nil, c.CreateIndex("from", byFrom))
+	tests.Assert(t, ErrIndexExists, c.CreateIndex("from", byFrom))
+
+	set("tx2", alice)
+	set("tx3", bob)
+
+	keys, _ := c.GetBy("from", alice[:])
+	tests.AssertEqual(t, [][]byte{[]byte("tx1"), []byte("tx2")}, keys)
+
+	// Move key to another value.
+	set("tx1", bob)
+
+	keys, _ = c.GetBy("from", alice[:])
+	tests.AssertEqual(t, [][]byte{[]byte("tx2")}, keys)
+
+	keys, _ = c.GetBy("from", bob[:])
+	tests.AssertEqual(t, [][]byte{[]byte("tx3"), []byte("tx1")}, keys)
+
+	// Deleted keys are removed from index.
+	c.Delete([]byte("tx2"))
+
+	keys, _ = c.GetBy("from", alice[:])
+	tests.AssertEqual(t, [][]byte{}, keys)
+
+	// Transactions keep index up to date too.
+	txn := c.Begin()
+	raw, _ := Encode(Transfer{From: alice, Value: 1})
+	txn.Set([]byte("tx4"), raw.Bytes())
+	txn.Commit()
+
+	keys, _ = c.GetBy("from", alice[:])
+	tests.AssertEqual(t, [][]byte{[]byte("tx4")}, keys)
+
+	_, err := c.GetBy("missing", alice[:])
+	tests.Assert(t, ErrIndexMissing, err)
+
+	// Index survives compaction and reopening.
+	c.Compact()
+	c.Close()
+
+	c, _ = OpenCollection("test", "./test")
+	c.CreateIndex("from", byFrom)
+
+	keys, _ = c.GetBy("from", bob[:])
+	tests.AssertEqual(t, [][]byte{[]byte("tx3"), []byte("tx1")}, keys)
+	c.Close()
+
+	// Writes made without index make it stale, it's rebuilt.
+	c, _ = OpenCollection("test", "./test")
+	set("tx5", bob)
+	c.CreateIndex("from", byFrom)
+
+	keys, _ = c.GetBy("from", bob[:])
+	tests.AssertEqual(t, [][]byte{[]byte("tx3"), []byte("tx1"), []byte("tx5")}, keys)
+}
+
+func TestSecondaryIndexExpired(t *testing.T) {
+	now := time.Now()
+	c, _ := OpenCollection("test", "./test", WithClock(func() time.Time { return now }))
+	defer os.RemoveAll("./test")
+
+	c.CreateIndex("from", byFrom)
+
+	raw, _ := Encode(Transfer{From: common.Address{1}, Value: 10})
+	c.SetWithTTL([]byte("tx1"), raw.Bytes(), time.Minute)
+	c.Set([]byte("tx2"), raw.Bytes())
+
+	// Expired keys are skipped before they are reaped.
+	now = now.Add(time.Hour)
+
+	keys, _ := c.GetBy("from", common.Address{1}.Bytes())
+	tests.AssertEqual(t, [][]byte{[]byte("tx2")}, keys)
+}
+
+func TestSecondaryIndexReload(t *testing.T) {
+	c, _ := OpenCollection("test", "./test")
+	defer os.RemoveAll("./test")
+	defer c.Close()
+
+	alice := common.Address{1}
+	raw, _ := Encode(Transfer{From: alice, Value: 10})
+
+	c.CreateIndex("from", byFrom)
+	c.Set([]byte("tx1"), raw.Bytes())
+
+	// Indexes are dropped with closed files.
+	tests.Assert(t, nil, c.Reload())
+
+	_, err := c.Set([]byte("tx2"), raw.Bytes())
+	tests.Assert(t, nil, err)
+
+	_, err = c.GetBy("from", alice[:])
+	tests.Assert(t, ErrIndexMissing, err)
+
+	// Index missed the write, it's rebuilt.
+	tests.Assert(t, nil, c.CreateIndex("from", byFrom))
+
+	keys, _ := c.GetBy("from", alice[:])
+	tests.AssertEqual(t, [][]byte{[]byte("tx1"), []byte("tx2")}, keys)
+}
@@ -0,0 +1,185 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+)
+
+var ErrTxnManaged = errors.New("transaction is managed by DB.Update")
+
+// Transaction spanning multiple collections.
+type Tx struct {
+	db   *DB
+	txns map[string]*Txn
+}
+
+// Get transaction for given collection. Collection is opened if needed.
+func (tx *Tx) Collection(name string) (*Txn, error) {
+	txn, ok := tx.txns[name]
+	if !ok {
+		c, err := tx.db.Collection(name)
+		if err != nil {
+			return nil, err
+		}
+
+		txn = c.Begin()
+		txn.managed = true
+		tx.txns[name] = txn
+	}
+
+	return txn, nil
+}
+
+// Run fn in a transaction spanning multiple collections. If fn returns
+// error, transaction is rolled back. Otherwise all writes are committed
+// atomically through the database wal.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	tx := &Tx{db: db, txns: map[string]*Txn{}}
+
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.commit()
+}
+
+func (tx *Tx) commit() error {
+	// Always lock collections in the same order to avoid deadlocks.
+	names := make([]string, 0, len(tx.txns))
+	for name := range tx.txns {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		txn := tx.txns[name]
+		txn.done = true
+
+		txn.c.lock()
+		defer txn.c.unlock()
+	}
+
+	for _, name := range names {
+		err := tx.txns[name].validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	log, logs, err := tx.encode(names)
+	if err != nil || len(log) == 0 {
+		return err
+	}
+
+	err = tx.db.wal.Append(log)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		log, ok := logs[name]
+		if !ok {
+			continue
+		}
+
+		err := tx.txns[name].c.apply(log)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.db.wal.Reset()
+}
+
+// Encode writes of all collections into a single log. Transaction logs
+// of collections are returned too, so they can be applied one by one.
+// Collections must be locked.
+//
+// Log layout, repeated for each collection:
+//
+//	name (bitbox) | collection transaction log (bitbox)
+func (tx *Tx) encode(names []string) ([]byte, map[string][]byte, error) {
+	buf := new(bytes.Buffer)
+	logs := map[string][]byte{}
+
+	for _, name := range names {
+		txn := tx.txns[name]
+		if len(txn.order) == 0 {
+			continue
+		}
+
+		log, err := txn.encode()
+		if err != nil {
+			return nil, nil, err
+		}
+		logs[name] = log
+
+		raw, _ := Encode([]byte(name), log)
+		buf.Write(raw.Bytes())
+	}
+
+	return buf.Bytes(), logs, nil
+}
+
+// Apply logged transactions which were not applied before crash.
+func (db *DB) recover() error {
+	var applyErr error
+
+	err := db.wal.Map(func(log []byte) {
+		if applyErr == nil {
+			applyErr = db.apply(log)
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if applyErr != nil {
+		return applyErr
+	}
+
+	return db.wal.Reset()
+}
+
+// Replay collection transaction log. Collections which need migration
+// keep it in their own log, it's applied after they are migrated.
+// Collection must be locked.
+func (c *Collection) replay(log []byte) error {
+	if c.format != FormatVersion {
+		return c.wal.Append(log)
+	}
+
+	return c.apply(log)
+}
+
+// Apply database transaction log.
+func (db *DB) apply(log []byte) error {
+	buf := bytes.NewBuffer(log)
+
+	for buf.Len() > 0 {
+		var name, txn []byte
+
+		err := Decode(buf, &name, &txn)
+		if err != nil {
+			return err
+		}
+
+		c, err := db.Collection(string(name))
+		if err != nil {
+			return err
+		}
+
+		c.lock()
+		err = c.replay(txn)
+		c.unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,278 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrConflict = errors.New("transaction conflict, read keys were modified")
+	ErrTxnDone  = errors.New("transaction is already committed or rolled back")
+)
+
+// Operations stored in transaction logs.
+const (
+	opSet uint8 = iota + 1
+	opDelete
+
+	// Set followed by the new version of the key. Replayed logs set
+	// the same version again, instead of incrementing it.
+	opSetVersion
+)
+
+// Optimistic transaction on a single collection.
+//
+// Writes are buffered in memory until commit. On commit, versions of
+// all read keys are compared with the current ones, if any of them
+// changed, transaction fails with ErrConflict. Deleted and expired
+// keys keep their versions, so keys deleted and created again are
+// detected too.
+type Txn struct {
+	c *Collection
+
+	// Keys at the time they were read.
+	reads map[string]txnRead
+
+	// Buffered writes in the order they were made.
+	writes map[string]*txnWrite
+	order  []string
+
+	// Part of DB transaction, committed by DB.Update.
+	managed bool
+
+	done bool
+}
+
+type txnWrite struct {
+	op  uint8
+	val []byte
+}
+
+// Key seen by transaction. Version of missing keys is their last
+// version, see Keys.lastVersion.
+type txnRead struct {
+	version uint32
+	found   bool
+}
+
+// Begin new transaction.
+func (c *Collection) Begin() *Txn {
+	return &Txn{c: c, reads: map[string]txnRead{}, writes: map[string]*txnWrite{}}
+}
+
+// Get key. Keys written in this transaction are returned from memory.
+func (t *Txn) Get(key []byte) ([]byte, error) {
+	if t.done {
+		return nil, ErrTxnDone
+	}
+
+	if w, ok := t.writes[string(key)]; ok {
+		if w.op == opDelete {
+			return nil, ErrNotFound
+		}
+		return w.val, nil
+	}
+
+	t.c.mu.RLock()
+	val, read, err := t.c.read(key)
+	t.c.mu.RUnlock()
+
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	// Remember only the first version we've seen.
+	if _, ok := t.reads[string(key)]; !ok {
+		t.reads[string(key)] = read
+	}
+
+	return val, err
+}
+
+// Get key together with its version. Collection must be locked.
+func (c *Collection) read(key []byte) ([]byte, txnRead, error) {
+	val, version, err := c.keys.GetWithVersion(key)
+	if err == nil {
+		return val, txnRead{version: version, found: true}, nil
+	}
+
+	if !errors.Is(err, ErrNotFound) {
+		return nil, txnRead{}, err
+	}
+
+	version, err = c.keys.lastVersion(key)
+	if err != nil {
+		return nil, txnRead{}, err
+	}
+
+	return nil, txnRead{version: version}, ErrNotFound
+}
+
+// Set key.
+func (t *Txn) Set(key, val []byte) error {
+	return t.write(opSet, key, val)
+}
+
+// Delete key.
+func (t *Txn) Delete(key []byte) error {
+	return t.write(opDelete, key, nil)
+}
+
+func (t *Txn) write(op uint8, key, val []byte) error {
+	if t.done {
+		return ErrTxnDone
+	}
+
+	if _, ok := t.writes[string(key)]; !ok {
+		t.order = append(t.order, string(key))
+	}
+
+	t.writes[string(key)] = &txnWrite{op: op, val: val}
+	return nil
+}
+
+// Commit transaction. All writes are stored in a single wal log
+// before they are applied, so they are applied all or none.
+func (t *Txn) Commit() error {
+	if t.managed {
+		return ErrTxnManaged
+	}
+
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+
+	c := t.c
+
+	c.lock()
+	defer c.unlock()
+
+	err := t.validate()
+	if err != nil {
+		return err
+	}
+
+	if len(t.order) == 0 {
+		return nil
+	}
+
+	log, err := t.encode()
+	if err != nil {
+		return err
+	}
+
+	return c.commit(log)
+}
+
+// Discard all writes.
+func (t *Txn) Rollback() error {
+	if t.managed {
+		return ErrTxnManaged
+	}
+
+	if t.done {
+		return ErrTxnDone
+	}
+
+	t.done = true
+	t.writes = nil
+
+	return nil
+}
+
+// Check if read keys were not modified. Collection must be locked.
+func (t *Txn) validate() error {
+	if t.c.format != FormatVersion {
+		return ErrOutdatedFormat
+	}
+
+	for key, read := range t.reads {
+		_, current, err := t.c.read([]byte(key))
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		if current != read {
+			return ErrConflict
+		}
+	}
+
+	return nil
+}
+
+// Encode all writes into transaction log. Sets are logged with new
+// versions of their keys, so collection must be locked.
+//
+// Log layout, repeated for each write:
+//
+//	op | key (bitbox) | value (bitbox) | version (bitbox, opSetVersion only)
+func (t *Txn) encode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	for _, key := range t.order {
+		w := t.writes[key]
+
+		if w.op == opDelete {
+			raw, _ := Encode(w.op, []byte(key), w.val)
+			buf.Write(raw.Bytes())
+			continue
+		}
+
+		version, err := t.c.keys.lastVersion([]byte(key))
+		if err != nil {
+			return nil, err
+		}
+
+		raw, _ := Encode(opSetVersion, []byte(key), w.val, version+1)
+		buf.Write(raw.Bytes())
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Apply transaction log. Collection must be locked.
+func (c *Collection) apply(log []byte) error {
+	buf := bytes.NewBuffer(log)
+
+	for buf.Len() > 0 {
+		var op uint8
+		var key, val []byte
+
+		err := Decode(buf, &op, &key, &val)
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case opSet:
+			// Logged before versions were, replay bumps version again.
+			_, err = c.set(key, val, 0)
+		case opSetVersion:
+			var version uint32
+
+			err = Decode(buf, &version)
+			if err != nil {
+				return err
+			}
+
+			_, err = c.setVersion(key, val, 0, version)
+		case opDelete:
+			err = c.delete(key)
+
+			// Key could be already deleted when log is replayed.
+			if errors.Is(err, ErrNotFound) {
+				err = nil
+			}
+		default:
+			err = fmt.Errorf("unknown transaction op: %d", op)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
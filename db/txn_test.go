@@ -0,0 +1,200 @@
+package db
+
+import (
+	"bucketdb/tests"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestTxnCommit(t *testing.T) {
+	c, _ := OpenCollection("test", "./test")
+	defer os.RemoveAll("./test")
+
+	c.Set([]byte("foo"), []byte("1"))
+
+	txn := c.Begin()
+	txn.Set([]byte("bar"), []byte("2"))
+	txn.Delete([]byte("foo"))
+
+	// Read your own writes.
+	val, _ := txn.Get([]byte("bar"))
+	tests.Assert(t, "2", string(val))
+
+	_, err := txn.Get([]byte("foo"))
+	tests.Assert(t, ErrNotFound, err)
+
+	// Nothing is visible before commit.
+	val, _ = c.Get([]byte("foo"))
+	tests.Assert(t, "1", string(val))
+
+	_, err = c.Get([]byte("bar"))
+	tests.Assert(t, ErrNotFound, err)
+
+	tests.Assert(t, nil, txn.Commit())
+	tests.Assert(t, ErrTxnDone, txn.Commit())
+
+	val, _ = c.Get([]byte("bar"))
+	tests.Assert(t, "2", string(val))
+
+	_, err = c.Get([]byte("foo"))
+	tests.Assert(t, ErrNotFound, err)
+}
+
+func TestTxnConflict(t *testing.T) {
+	c, _ := OpenCollection("test", "./test")
+	defer os.RemoveAll("./test")
+
+	c.Set([]byte("balance"), []byte{10})
+
+	txn1 := c.Begin()
+	txn2 := c.Begin()
+
+	val1, _ := txn1.Get([]byte("balance"))
+	val2, _ := txn2.Get([]byte("balance"))
+
+	txn1.Set([]byte("balance"), []byte{val1[0] + 1})
+	txn2.Set([]byte("balance"), []byte{val2[0] + 2})
+
+	tests.Assert(t, nil, txn1.Commit())
+	tests.Assert(t, ErrConflict, txn2.Commit())
+
+	val, _ := c.Get([]byte("balance"))
+	tests.Assert(t, 11, int(val[0]))
+
+	// Missing keys are validated too.
+	txn3 := c.Begin()
+	txn3.Get([]byte("missing"))
+	txn3.Set([]byte("missing"), []byte("foo"))
+
+	c.Set([]byte("missing"), []byte("bar"))
+	tests.Assert(t, ErrConflict, txn3.Commit())
+}
+
+func TestTxnRollback(t *testing.T) {
+	c, _ := OpenCollection("test", "./test")
+	defer os.RemoveAll("./test")
+
+	txn := c.Begin()
+	txn.Set([]byte("foo"), []byte("bar"))
+	txn.Rollback()
+
+	tests.Assert(t, ErrTxnDone, txn.Commit())
+
+	_, err := c.Get([]byte("foo"))
+	tests.Assert(t, ErrNotFound, err)
+}
+
+func TestTxnRecover(t *testing.T) {
+	c, _ := OpenCollection("test", "./test")
+	defer os.RemoveAll("./test")
+
+	// Simulate crash after transaction was logged but before it was applied.
+	txn := c.Begin()
+	txn.Set([]byte("foo"), []byte("1"))
+	txn.Set([]byte("bar"), []byte("2"))
+
+	log, _ := txn.encode()
+	c.wal.Append(log)
+	c.Close()
+
+	c, _ = OpenCollection("test", "./test")
+
+	val, _ := c.Get([]byte("foo"))
+	tests.Assert(t, "1", string(val))
+
+	val, _ = c.Get([]byte("bar"))
+	tests.Assert(t, "2", string(val))
+
+	// Simulate crash after log was applied but before it was reset,
+	// replay must not bump versions again.
+	c.wal.Append(log)
+	c.Close()
+
+	c, _ = OpenCollection("test", "./test")
+	defer c.Close()
+
+	_, version, _ := c.GetWithVersion([]byte("foo"))
+	tests.Assert(t, 1, version)
+}
+
+func TestTxnRecoverAfterMigration(t *testing.T) {
+	c, _ := OpenCollection("test", "./test")
+	defer os.RemoveAll("./test")
+
+	txn := c.Begin()
+	txn.Set([]byte("foo"), []byte("1"))
+
+	log, _ := txn.encode()
+	c.wal.Append(log)
+	c.Close()
+
+	// Logs of old collections wait until they are migrated.
+	WriteFormat("./test", 5)
+	c, _ = OpenCollection("test", "./test")
+
+	_, err := c.Get([]byte("foo"))
+	tests.Assert(t, true, errors.Is(err, ErrNotFound))
+
+	migrateCollection(t, c)
+
+	val, _ := c.Get([]byte("foo"))
+	tests.Assert(t, "1", string(val))
+
+	// Next commit doesn't overwrite the log.
+	txn = c.Begin()
+	txn.Set([]byte("bar"), []byte("2"))
+	tests.Assert(t, nil, txn.Commit())
+	c.Close()
+
+	c, _ = OpenCollection("test", "./test")
+	defer c.Close()
+
+	val, _ = c.Get([]byte("foo"))
+	tests.Assert(t, "1", string(val))
+}
+
+// Migrate collection the way migrate.Collection does.
+func migrateCollection(t *testing.T, c *Collection) {
+	t.Helper()
+
+	tmp := c.Root() + ".migrate"
+	defer os.RemoveAll(tmp)
+
+	old, _ := OpenKeys(DataDir(c.Root()), IndexDir(c.Root()), WithFormat(c.Format()))
+	keys, _ := OpenKeys(DataDir(tmp), IndexDir(tmp))
+
+	tests.Assert(t, nil, old.CopyTo(keys))
+	old.Close()
+	keys.Close()
+	WriteFormat(tmp, FormatVersion)
+
+	tests.Assert(t, nil, c.Swap(tmp))
+}
+
+func TestTxnDeleteConflict(t *testing.T) {
+	c, _ := OpenCollection("test", "./test")
+	defer os.RemoveAll("./test")
+
+	c.Set([]byte("foo"), []byte("1"))
+
+	// Key is deleted and created again after it was read.
+	txn := c.Begin()
+	txn.Get([]byte("foo"))
+
+	c.Delete([]byte("foo"))
+	c.Set([]byte("foo"), []byte("1"))
+
+	txn.Set([]byte("foo"), []byte("2"))
+	tests.Assert(t, ErrConflict, txn.Commit())
+
+	// Missing key is created and deleted again after it was read.
+	txn = c.Begin()
+	txn.Get([]byte("bar"))
+
+	c.Set([]byte("bar"), []byte("1"))
+	c.Delete([]byte("bar"))
+
+	txn.Set([]byte("bar"), []byte("2"))
+	tests.Assert(t, ErrConflict, txn.Commit())
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"bytes"
+)
+
+// Collection storing values of type V under keys of type K.
+//
+// Keys and values are serialized with bitbox. Types implementing
+// Encoder/Decoder are serialized using them instead, []byte and
+// string keys are stored as they are.
+type TypedCollection[K any, V any] struct {
+	c *Collection
+}
+
+func NewTypedCollection[K any, V any](c *Collection) *TypedCollection[K, V] {
+	return &TypedCollection[K, V]{c: c}
+}
+
+// Underlying collection.
+func (t *TypedCollection[K, V]) Collection() *Collection {
+	return t.c
+}
+
+// Store value under given key.
+func (t *TypedCollection[K, V]) Put(k K, v *V) error {
+	key, err := encodeTyped(&k)
+	if err != nil {
+		return err
+	}
+
+	val, err := encodeTyped(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.c.Set(key, val)
+	return err
+}
+
+// Get value stored under given key.
+func (t *TypedCollection[K, V]) Get(k K) (*V, error) {
+	key, err := encodeTyped(&k)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := t.c.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	v := new(V)
+	return v, decodeTyped(raw, v)
+}
+
+// Delete key.
+func (t *TypedCollection[K, V]) Delete(k K) error {
+	key, err := encodeTyped(&k)
+	if err != nil {
+		return err
+	}
+
+	return t.c.Delete(key)
+}
+
+// Iterate all keys and values. Collection must not be modified in fn.
+func (t *TypedCollection[K, V]) Each(fn func(k K, v *V) error) error {
+	return t.c.Each(func(key, val []byte) error {
+		var k K
+
+		err := decodeTyped(key, &k)
+		if err != nil {
+			return err
+		}
+
+		v := new(V)
+
+		err = decodeTyped(val, v)
+		if err != nil {
+			return err
+		}
+
+		return fn(k, v)
+	})
+}
+
+func encodeTyped[T any](v *T) ([]byte, error) {
+	switch val := any(v).(type) {
+	case Encoder:
+		return val.Encode(), nil
+	case *[]byte:
+		return *val, nil
+	case *string:
+		return []byte(*val), nil
+	}
+
+	buf, err := Encode(*v)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decodeTyped[T any](raw []byte, v *T) error {
+	switch val := any(v).(type) {
+	case Decoder:
+		return val.Decode(raw)
+	case *[]byte:
+		*val = raw
+		return nil
+	case *string:
+		*val = string(raw)
+		return nil
+	}
+
+	return Decode(bytes.NewBuffer(raw), v)
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"bucketdb/tests"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type Account struct {
+	Address common.Address
+	Nonce   uint64
+	Balance uint64
+}
+
+func TestTypedCollectionPutGet(t *testing.T) {
+	col, _ := OpenCollection("test", "./test")
+	c := NewTypedCollection[string, Account](col)
+	defer os.RemoveAll("./test")
+
+	acc := &Account{Address: common.Address{1, 2, 3}, Nonce: 7, Balance: 1000}
+	tests.Assert(t, nil, c.Put("alice", acc))
+
+	res, err := c.Get("alice")
+	tests.Assert(t, nil, err)
+	tests.AssertEqual(t, acc, res)
+
+	c.Delete("alice")
+
+	_, err = c.Get("alice")
+	tests.Assert(t, ErrNotFound, err)
+}
+
+func TestTypedCollectionCustomCodec(t *testing.T) {
+	col, _ := OpenCollection("test", "./test")
+	c := NewTypedCollection[uint64, TestStruct](col)
+	defer os.RemoveAll("./test")
+
+	c.Put(1, &TestStruct{[]byte{1, 2, 3}})
+
+	res, _ := c.Get(1)
+	tests.AssertEqual(t, []byte{1, 2, 3}, res.Data)
+}
+
+func TestTypedCollectionEach(t *testing.T) {
+	col, _ := OpenCollection("test", "./test")
+	c := NewTypedCollection[uint64, Account](col)
+	defer os.RemoveAll("./test")
+
+	for i := uint64(1); i <= 10; i++ {
+		c.Put(i, &Account{Nonce: i})
+	}
+
+	// Overwritten values are skipped.
+	c.Put(5, &Account{Nonce: 50})
+
+	sum := uint64(0)
+	count := 0
+
+	c.Each(func(k uint64, v *Account) error {
+		sum += v.Nonce
+		count += 1
+		return nil
+	})
+
+	tests.Assert(t, 10, count)
+	tests.Assert(t, uint64(55-5+50), sum)
+}
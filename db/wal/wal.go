@@ -1,16 +1,31 @@
 package wal
 
 import (
+	"bucketdb/db/crypt"
 	"bucketdb/db/mmap"
+	"errors"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 	"unsafe"
 )
 
+var (
+	ErrFull    = errors.New("wal is full")
+	ErrCorrupt = errors.New("wal is corrupted")
+)
+
 type Wal struct {
 	file *mmap.Mmap
 	Logs chan []byte
+
+	// Encrypts logs, nil if encryption is disabled.
+	// Must be set before writing any logs.
+	Cipher *crypt.Cipher
+
+	// Guards synchronous appends.
+	mu sync.Mutex
 }
 
 // Open the wal file that we will be writing to.
@@ -22,14 +37,25 @@ func Open(path string, size int64) (*Wal, error) {
 	}
 
 	mmap, err := mmap.Open(file, int(size), 0)
-	mmap.Resize(size)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	err = mmap.Resize(size)
+	if err != nil {
+		mmap.Close()
+		return nil, err
+	}
 
 	w := &Wal{file: mmap, Logs: make(chan []byte, 1000)}
 	return w, nil
 }
 
 // Start main loop responsible for writing data to wal file.
-func (w *Wal) Start(timeout int) {
+// It stops on the first failed write or sync and returns its error,
+// logs sent after that are not written.
+func (w *Wal) Start(timeout int) error {
 	ticker := time.NewTicker(time.Duration(timeout) * time.Millisecond)
 	defer ticker.Stop()
 
@@ -39,23 +65,34 @@ func (w *Wal) Start(timeout int) {
 			// Got new data, write it to the wal file.
 			// If channel was closed, sync data and return.
 			if !open {
-				w.file.Sync()
-				return
+				return w.file.Sync()
+			}
+
+			err := w.write(data)
+			if err != nil {
+				return err
 			}
-			w.write(data)
 
 		case _ = <-ticker.C:
 			// Periodically call msync and flush data to file.
 			err := w.file.Sync()
 			if err != nil {
-				fmt.Println(err)
+				return err
 			}
 		}
 	}
 }
 
 // Write log to wal file.
-func (w *Wal) write(data []byte) {
+func (w *Wal) write(data []byte) error {
+	if w.Cipher != nil {
+		sealed, err := w.Cipher.Seal(data)
+		if err != nil {
+			return err
+		}
+		data = sealed
+	}
+
 	// We need a length prefix for each log so we will
 	// be able to iterate them.
 	size := uint32(len(data))
@@ -68,8 +105,74 @@ func (w *Wal) write(data []byte) {
 
 	n := w.file.Write(log)
 	if n != len(log) {
-		fmt.Printf("Wal should write %d bytes, wrote only %d\n", len(log), n)
+		return fmt.Errorf("%w: wrote %d of %d bytes", ErrFull, n, len(log))
 	}
+
+	return nil
+}
+
+// Write log to wal file and wait until it's synced to disk.
+//
+// Length prefix is written only after the log itself is on disk,
+// so a partially written log is never visible to Map.
+func (w *Wal) Append(data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.Cipher != nil {
+		sealed, err := w.Cipher.Seal(data)
+		if err != nil {
+			return err
+		}
+		data = sealed
+	}
+
+	start := w.file.WriteOffset
+
+	// Log with length prefix and empty length for the next one.
+	if start+4+len(data)+4 > w.file.Len() {
+		return ErrFull
+	}
+
+	size := uint32(len(data))
+	ptr := (*[4]byte)(unsafe.Pointer(&size))
+
+	w.file.WriteOffset += 4
+	w.file.Write(data)
+	w.file.Write(make([]byte, 4))
+
+	err := w.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	end := w.file.WriteOffset - 4
+
+	w.file.WriteOffset = start
+	w.file.Write(ptr[:])
+	w.file.WriteOffset = end
+
+	return w.file.Sync()
+}
+
+// Discard all logs.
+func (w *Wal) Reset() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.file.WriteOffset = 0
+	w.file.ReadOffset = 0
+
+	// Empty length prefix marks the end of logs.
+	w.file.Write(make([]byte, 4))
+	w.file.WriteOffset = 0
+
+	return w.file.Sync()
+}
+
+// Sync and close wal file.
+func (w *Wal) Close() error {
+	return w.file.Close()
 }
 
 // Read all logs and pass them to the user defined map function.
@@ -78,14 +181,28 @@ func (w *Wal) Map(fn func(log []byte)) error {
 		len := uint32(0)
 		ptr := (*[4]byte)(unsafe.Pointer(&len))
 
-		w.file.ReadTo(ptr[:])
-
 		// No more logs to read.
-		if len == 0 {
+		err := w.file.ReadTo(ptr[:])
+		if err != nil || len == 0 {
 			return nil
 		}
 
+		// Length prefix can't point past the end of file.
+		if int64(len) > int64(w.file.Len()-w.file.ReadOffset) {
+			return fmt.Errorf("%w: log of %d bytes at %d", ErrCorrupt, len, w.file.ReadOffset-4)
+		}
+
 		log, _ := w.file.Read(int(len))
+
+		if w.Cipher != nil {
+			var err error
+
+			log, err = w.Cipher.Open(log)
+			if err != nil {
+				return err
+			}
+		}
+
 		fn(log)
 	}
 }
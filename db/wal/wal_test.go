@@ -1,8 +1,11 @@
 package wal
 
 import (
+	"bucketdb/db/crypt"
 	"bucketdb/tests"
+	"bytes"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -39,3 +42,101 @@ func TestMap(t *testing.T) {
 	wal.Map(count)
 	tests.Assert(t, 99_000, counter)
 }
+
+func TestMapEncrypted(t *testing.T) {
+	wal, _ := Open("test.wal", 1_000_000)
+	defer os.Remove("test.wal")
+
+	wal.Cipher = crypt.New(crypt.NewKeyRing(1, bytes.Repeat([]byte{1}, 32)))
+
+	data := []byte("Hello Wal :D")
+	for i := 0; i < 100; i++ {
+		wal.write(data)
+	}
+
+	// Logs must not be stored in plain text.
+	wal.file.Sync()
+	raw, _ := os.ReadFile("test.wal")
+	tests.Assert(t, -1, bytes.Index(raw, data))
+
+	logs := [][]byte{}
+	err := wal.Map(func(log []byte) { logs = append(logs, log) })
+
+	tests.Assert(t, nil, err)
+	tests.Assert(t, 100, len(logs))
+	tests.AssertEqual(t, data, logs[99])
+}
+
+func TestWriteSealError(t *testing.T) {
+	wal, _ := Open("test.wal", 1_000_000)
+	defer os.Remove("test.wal")
+
+	// Invalid key size, logs can't be sealed.
+	wal.Cipher = crypt.New(crypt.NewKeyRing(1, []byte("short")))
+
+	go func() {
+		wal.Logs <- []byte("Hello Wal :D")
+	}()
+
+	tests.Assert(t, true, wal.Start(20) != nil)
+	tests.Assert(t, 0, wal.file.WriteOffset)
+
+	tests.Assert(t, true, wal.Append([]byte("Hello Wal :D")) != nil)
+}
+
+func TestAppendReset(t *testing.T) {
+	wal, _ := Open("test.wal", 100)
+	defer os.Remove("test.wal")
+
+	tests.Assert(t, nil, wal.Append([]byte("foo")))
+	tests.Assert(t, nil, wal.Append([]byte("bar")))
+
+	// No space left.
+	tests.Assert(t, ErrFull, wal.Append(make([]byte, 100)))
+
+	// Logs must be visible after reopening the file.
+	wal.Close()
+	wal, _ = Open("test.wal", 100)
+
+	logs := []string{}
+	wal.Map(func(log []byte) { logs = append(logs, string(log)) })
+	tests.AssertEqual(t, []string{"foo", "bar"}, logs)
+
+	// Old logs must not be visible after reset.
+	wal.Reset()
+	wal.Append([]byte("baz"))
+
+	wal.Close()
+	wal, _ = Open("test.wal", 100)
+
+	logs = []string{}
+	wal.Map(func(log []byte) { logs = append(logs, string(log)) })
+	tests.AssertEqual(t, []string{"baz"}, logs)
+}
+
+func FuzzMap(f *testing.F) {
+	f.Add([]byte{3, 0, 0, 0, 'f', 'o', 'o', 0, 0, 0, 0}, false)
+	f.Add([]byte{255, 255, 255, 127, 1, 2, 3}, false)
+	f.Add([]byte{1, 0, 0, 0}, false)
+	f.Add(make([]byte, 40), true)
+
+	c := crypt.New(crypt.NewKeyRing(1, bytes.Repeat([]byte{1}, 32)))
+	path := filepath.Join(f.TempDir(), "fuzz.wal")
+
+	f.Fuzz(func(t *testing.T, data []byte, encrypted bool) {
+		err := os.WriteFile(path, data, 0644)
+		tests.Assert(t, nil, err)
+
+		wal, err := Open(path, int64(len(data)))
+		if err != nil {
+			return
+		}
+		defer wal.Close()
+
+		if encrypted {
+			wal.Cipher = c
+		}
+
+		wal.Map(func(log []byte) {})
+	})
+}
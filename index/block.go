@@ -1,31 +1,61 @@
 package index
 
 import (
-	"unsafe"
+	"bucketdb/db/page"
 )
 
-const BlockSize = 4096
-const HeaderSize = int(unsafe.Sizeof(Header{}))
-const DataSize = BlockSize - HeaderSize
+// Default block size, see NewBlock.
+const BlockSize = page.MinSize
 
-type Header struct {
-	Offset uint32
+// Index block, the same page layout as blocks in db files.
+type Block struct {
+	Header *page.Header
+	Data   []byte
+
+	// Whole page, header included, see page.Seal.
+	raw []byte
 }
 
-type Block struct {
-	Header Header
-	Data   [DataSize]byte
+// Create empty block of given size, 4 to 64 KiB.
+func NewBlock(size int) (*Block, error) {
+	err := page.CheckSize(size)
+	if err != nil {
+		return nil, err
+	}
+
+	return Open(make([]byte, size))
+}
+
+// Open block stored in data, block size is the length of data.
+func Open(data []byte) (*Block, error) {
+	h, err := page.Of(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Block{Header: h, Data: data[page.HeaderSize:], raw: data}, nil
 }
 
 // Write bytes to block and return the number of bytes written
 func (b *Block) Write(data []byte) int {
+	if b.Header.Type == page.Empty {
+		size := len(b.Data) + page.HeaderSize
+
+		b.Header.Init(page.Raw, size)
+		b.Header.SetSize(size)
+	}
+
 	// Check if block has enough space
-	if int(b.Header.Offset)+len(data) > len(b.Data) {
+	if b.Header.Type != page.Raw || int(b.Header.Len)+len(data) > len(b.Data) {
 		return 0
 	}
 
-	n := copy(b.Data[b.Header.Offset:], data)
-	b.Header.Offset += uint32(n)
+	n := copy(b.Data[b.Header.Len:], data)
+	b.Header.Len += int32(n)
+	b.Header.Free -= int32(n)
+
+	// Checksum is kept up to date, so block can be written as it is.
+	page.Seal(b.raw)
 
 	return n
 }
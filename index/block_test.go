@@ -1,6 +1,7 @@
 package index
 
 import (
+	"bucketdb/db/page"
 	"bucketdb/tests"
 	"testing"
 )
@@ -9,9 +10,41 @@ func TestBlockWriteRead(t *testing.T) {
 	foo := []byte("foo")
 	bar := make([]byte, 3)
 
-	b := Block{}
+	b, _ := NewBlock(BlockSize)
 	b.Write(foo)
 	b.Read(0, bar)
 
 	tests.AssertEqual(t, foo, bar)
 }
+
+func TestBlockHeader(t *testing.T) {
+	data := make([]byte, 16<<10)
+
+	b, _ := Open(data)
+	tests.Assert(t, page.Empty, b.Header.Type)
+
+	b.Write([]byte("foo"))
+	tests.Assert(t, page.Raw, b.Header.Type)
+	tests.Assert(t, 3, b.Header.Len)
+	tests.Assert(t, int32(page.Payload(16<<10)-3), b.Header.Free)
+	tests.Assert(t, 16<<10, b.Header.Size())
+
+	// Block can be read as a page.
+	h, err := page.Of(data)
+	tests.AssertEqual(t, nil, err)
+	tests.Assert(t, 3, h.Len)
+	tests.AssertEqual(t, nil, page.Verify(data))
+}
+
+func TestBlockSize(t *testing.T) {
+	for _, size := range []int{4 << 10, 8 << 10, 64 << 10} {
+		b, err := NewBlock(size)
+		tests.AssertEqual(t, nil, err)
+		tests.Assert(t, size-page.HeaderSize, len(b.Data))
+	}
+
+	for _, size := range []int{0, 1000, 6 << 10, 128 << 10} {
+		_, err := NewBlock(size)
+		tests.AssertEqual(t, page.ErrSize, err)
+	}
+}